@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"social-network-common/env"
+	"social-network-common/pglsn"
+)
+
+type node struct {
+	name string
+	url  string
+	// replHost is host:port the other nodes stream from, if it differs from the URL
+	replHost string
+
+	conn *pgx.Conn
+	err  error // connection or inspection error, the node is treated as down
+
+	inRecovery bool
+	receiveLSN pglsn.LSN // WAL received (standby) or written (primary)
+	replayLSN  pglsn.LSN
+	syncNames  string // synchronous_standby_names
+}
+
+func (n *node) role() string {
+	switch {
+	case n.err != nil:
+		return "down"
+	case n.inRecovery:
+		return "standby"
+	default:
+		return "primary"
+	}
+}
+
+type cluster struct {
+	nodes []*node // sorted by name
+}
+
+// loadCluster reads "name=url,name=url" and optional "name=host:port,..." replication addresses
+func loadCluster(nodeList, replHosts string) (*cluster, error) {
+	urls, err := env.ParseList(nodeList)
+	if err != nil {
+		return nil, fmt.Errorf("nodes: %w", err)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no nodes, set -nodes or PGCTL_NODES")
+	}
+	hosts, err := env.ParseList(replHosts)
+	if err != nil {
+		return nil, fmt.Errorf("replication hosts: %w", err)
+	}
+
+	c := &cluster{}
+	for name, u := range urls {
+		c.nodes = append(c.nodes, &node{name: name, url: u, replHost: hosts[name]})
+		delete(hosts, name)
+	}
+	for name := range hosts {
+		return nil, fmt.Errorf("replication host for unknown node %q", name)
+	}
+	sort.Slice(c.nodes, func(i, j int) bool { return c.nodes[i].name < c.nodes[j].name })
+	return c, nil
+}
+
+func (c *cluster) node(name string) *node {
+	for _, n := range c.nodes {
+		if n.name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+func (c *cluster) close() {
+	for _, n := range c.nodes {
+		if n.conn != nil {
+			n.conn.Close(context.Background())
+		}
+	}
+}
+
+// inspect connects to every node and reads its role and WAL positions;
+// an unreachable node is kept with err set
+func (c *cluster) inspect(ctx context.Context) {
+	for _, n := range c.nodes {
+		if n.conn == nil {
+			connCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			n.conn, n.err = pgx.Connect(connCtx, n.url)
+			cancel()
+			if n.err != nil {
+				n.conn = nil
+				continue
+			}
+		}
+		n.err = n.refresh(ctx)
+	}
+}
+
+func (n *node) refresh(ctx context.Context) error {
+	return n.conn.QueryRow(ctx, `
+		SELECT pg_is_in_recovery(),
+		       CASE WHEN pg_is_in_recovery()
+		            THEN COALESCE(pg_last_wal_receive_lsn(), pg_last_wal_replay_lsn())
+		            ELSE pg_current_wal_lsn() END::text,
+		       CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END::text,
+		       current_setting('synchronous_standby_names')`).
+		Scan(&n.inRecovery, &n.receiveLSN, &n.replayLSN, &n.syncNames)
+}
+
+func (c *cluster) byRole(role string) []*node {
+	var result []*node
+	for _, n := range c.nodes {
+		if n.role() == role {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// mostAdvanced picks the standby with the most WAL received, then replayed;
+// ties go to the first by name
+func mostAdvanced(standbys []*node) *node {
+	var best *node
+	for _, n := range standbys {
+		if best == nil || n.receiveLSN > best.receiveLSN ||
+			(n.receiveLSN == best.receiveLSN && n.replayLSN > best.replayLSN) {
+			best = n
+		}
+	}
+	return best
+}
+
+type replicationRow struct {
+	ApplicationName string
+	ClientAddr      string
+	State           string
+	SyncState       string
+	SentLSN         pglsn.LSN
+	ReplayLSN       pglsn.LSN
+	ReplayLag       time.Duration
+}
+
+// replication reads pg_stat_replication of a primary
+func (n *node) replication(ctx context.Context) ([]replicationRow, error) {
+	rows, err := n.conn.Query(ctx, `
+		SELECT application_name, COALESCE(client_addr::text, ''), state, sync_state,
+		       COALESCE(sent_lsn, '0/0')::text, COALESCE(replay_lsn, '0/0')::text,
+		       COALESCE(replay_lag, interval '0')
+		FROM pg_stat_replication
+		ORDER BY application_name`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (replicationRow, error) {
+		var r replicationRow
+		err := row.Scan(&r.ApplicationName, &r.ClientAddr, &r.State, &r.SyncState, &r.SentLSN, &r.ReplayLSN, &r.ReplayLag)
+		return r, err
+	})
+}
+
+// primaryConninfo is what a standby puts into primary_conninfo to stream from
+// primary; application_name is the standby's node name, which
+// synchronous_standby_names refers to. The second result has the password
+// masked for logs.
+func primaryConninfo(primary, standby *node, user, password string) (string, string, error) {
+	u, err := url.Parse(primary.url)
+	if err != nil {
+		return "", "", fmt.Errorf("node %s: %w", primary.name, err)
+	}
+	hostPort := primary.replHost
+	if hostPort == "" {
+		hostPort = u.Host
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, "5432"
+	}
+	if user == "" {
+		user = u.User.Username()
+	}
+	if password == "" {
+		password, _ = u.User.Password()
+	}
+
+	conninfo := func(password string) string {
+		parts := []string{"host=" + conninfoValue(host), "port=" + conninfoValue(port), "user=" + conninfoValue(user)}
+		if password != "" {
+			parts = append(parts, "password="+conninfoValue(password))
+		}
+		parts = append(parts, "application_name="+conninfoValue(standby.name))
+		return strings.Join(parts, " ")
+	}
+	masked := ""
+	if password != "" {
+		masked = "********"
+	}
+	return conninfo(password), conninfo(masked), nil
+}
+
+func conninfoValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// quoteIdent quotes a role or standby name
+func quoteIdent(v string) string {
+	return `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a string for ALTER SYSTEM, which takes no parameters
+func quoteLiteral(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var errUnhealthy = errors.New("cluster is not healthy")
+
+// status logs the topology and the replication of the primary; it fails if
+// there is not exactly one primary or a standby is not streaming from it
+func status(ctx context.Context, r *runner, c *cluster) error {
+	c.inspect(ctx)
+	r.logTopology(c)
+
+	primaries := c.byRole("primary")
+	healthy := true
+	if len(primaries) != 1 {
+		r.warn("inspect", "want exactly one primary", "primaries", nodeNames(primaries))
+		healthy = false
+	}
+	for _, n := range c.byRole("down") {
+		r.warn("inspect", "node is down", "node", n.name)
+		healthy = false
+	}
+
+	for _, primary := range primaries {
+		rows, err := primary.replication(ctx)
+		if err != nil {
+			return fmt.Errorf("pg_stat_replication on %s: %w", primary.name, err)
+		}
+		streaming := make(map[string]bool)
+		for _, row := range rows {
+			r.info("replication", "standby",
+				"primary", primary.name,
+				"application_name", row.ApplicationName,
+				"client_addr", row.ClientAddr,
+				"state", row.State,
+				"sync_state", row.SyncState,
+				"sent_lsn", row.SentLSN.String(),
+				"replay_lsn", row.ReplayLSN.String(),
+				"lag_bytes", int64(primary.receiveLSN-min(row.ReplayLSN, primary.receiveLSN)),
+				"replay_lag", row.ReplayLag)
+			streaming[row.ApplicationName] = row.State == "streaming"
+		}
+		for _, n := range c.byRole("standby") {
+			if !streaming[n.name] {
+				r.warn("replication", "standby is not streaming from the primary", "node", n.name, "primary", primary.name)
+				healthy = false
+			}
+		}
+	}
+
+	if !healthy {
+		return errUnhealthy
+	}
+	r.info("status", "cluster is healthy")
+	return nil
+}
+
+type failoverOptions struct {
+	options
+	switchover bool
+	candidate  string
+	sync       string
+	fenceRoles []string
+}
+
+// failover promotes a standby and moves the rest of the cluster to it:
+//
+//  1. inspect: roles and WAL positions of every node
+//  2. fence (-switchover only): make the running primary read-only, take LOGIN
+//     away from the -fence-roles, cut its clients and wait for the candidate to
+//     replay everything it wrote. Without -fence-roles the fence is only
+//     best-effort, so promotion then waits for the old primary to be stopped.
+//  3. promote: pg_promote() on the most advanced standby (or -candidate)
+//  4. unfence: give LOGIN back to the -fence-roles on the new primary, which
+//     replayed the NOLOGIN
+//  5. sync-off: clear synchronous_standby_names on the new primary so commits
+//     do not hang until the standbys are back
+//  6. repoint: point primary_conninfo of the other standbys to the new primary
+//  7. sync-on: once they stream again, make them synchronous (-sync)
+//
+// An old primary is never turned into a standby here: that takes pg_rewind
+// and a restart, after which "pgctl repoint" finishes the job.
+func failover(ctx context.Context, r *runner, c *cluster, opts failoverOptions) error {
+	if opts.sync != "auto" && opts.sync != "on" && opts.sync != "off" {
+		return fmt.Errorf("invalid -sync %q, want auto, on or off", opts.sync)
+	}
+
+	c.inspect(ctx)
+	r.logTopology(c)
+
+	primaries, standbys := c.byRole("primary"), c.byRole("standby")
+	if len(primaries) > 1 {
+		return fmt.Errorf("several primaries (%s), resolve that first", nodeNames(primaries))
+	}
+	var old *node
+	if len(primaries) == 1 {
+		old = primaries[0]
+		if !opts.switchover {
+			return fmt.Errorf("primary %s is up: stop it or use -switchover", old.name)
+		}
+	}
+	if len(standbys) == 0 {
+		return errors.New("no reachable standby to promote")
+	}
+
+	syncOn := opts.sync == "on"
+	if opts.sync == "auto" {
+		syncOn = slices.ContainsFunc(c.nodes, func(n *node) bool { return n.err == nil && n.syncNames != "" })
+	}
+
+	candidate := mostAdvanced(standbys)
+	if opts.candidate != "" {
+		candidate = c.node(opts.candidate)
+		if candidate == nil || candidate.role() != "standby" {
+			return fmt.Errorf("candidate %s is not a reachable standby", opts.candidate)
+		}
+	}
+	r.info("candidate", "promoting", "node", candidate.name,
+		"receive_lsn", candidate.receiveLSN.String(), "replay_lsn", candidate.replayLSN.String())
+	for _, n := range standbys {
+		if n != candidate && n.receiveLSN > candidate.receiveLSN {
+			r.warn("candidate", "standby is ahead of the candidate and will need pg_rewind", "node", n.name,
+				"receive_lsn", n.receiveLSN.String())
+		}
+	}
+
+	if old != nil {
+		if err := checkFenceRoles(candidate, opts.replUser, opts.fenceRoles); err != nil {
+			return err
+		}
+		if err := fence(ctx, r, old, candidate, opts.fenceRoles, opts.timeout); err != nil {
+			return err
+		}
+		if len(opts.fenceRoles) == 0 {
+			if err := waitStopped(ctx, r, old, opts.timeout); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := promote(ctx, r, candidate, opts.timeout); err != nil {
+		return err
+	}
+	if old != nil {
+		for _, role := range opts.fenceRoles {
+			if err := r.exec(ctx, "unfence", candidate, "ALTER ROLE "+quoteIdent(role)+" LOGIN", ""); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.setConfig(ctx, "sync-off", candidate, "synchronous_standby_names", "", ""); err != nil {
+		return err
+	}
+
+	var others []string
+	for _, n := range standbys {
+		if n != candidate {
+			others = append(others, n.name)
+		}
+	}
+	if err := repointStandbys(ctx, r, c, opts.options, candidate, others); err != nil {
+		return err
+	}
+
+	if syncOn && len(others) > 0 {
+		if err := enableSync(ctx, r, candidate, others, 1); err != nil {
+			return err
+		}
+	}
+
+	if old != nil {
+		r.warn("rejoin", "old primary is fenced; rewind it and start it as a standby, then run pgctl repoint",
+			"node", old.name, "primary", candidate.name)
+	}
+	r.info("failover", "done", "primary", candidate.name, "dry_run", r.dryRun)
+	return nil
+}
+
+// fence stops writes on a running primary and waits for the candidate to replay them all.
+//
+// default_transaction_read_only only turns away well-behaved clients: any
+// session can SET it off or run SET TRANSACTION READ WRITE. The clients that
+// reconnect are kept out by ALTER ROLE ... NOLOGIN of roles; without them the
+// caller has to make sure the old primary is stopped (waitStopped).
+func fence(ctx context.Context, r *runner, primary, candidate *node, roles []string, timeout time.Duration) error {
+	// The reload makes this session read-only as well, so the roles go first
+	for _, role := range roles {
+		if err := r.exec(ctx, "fence", primary, "ALTER ROLE "+quoteIdent(role)+" NOLOGIN", ""); err != nil {
+			return err
+		}
+	}
+	if err := r.setConfig(ctx, "fence", primary, "default_transaction_read_only", "on", ""); err != nil {
+		return err
+	}
+	// Sessions keep the setting they started with, so the clients are disconnected
+	if err := r.exec(ctx, "fence", primary, `
+		SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()`, ""); err != nil {
+		return err
+	}
+	if err := primary.refresh(ctx); err != nil {
+		return fmt.Errorf("fence on %s: %w", primary.name, err)
+	}
+	target := primary.receiveLSN
+	r.info("fence", "primary is read-only", "node", primary.name, "lsn", target.String())
+
+	return r.wait(ctx, "catch-up", candidate.name+" to replay "+target.String(), timeout, func(ctx context.Context) (bool, error) {
+		if err := candidate.refresh(ctx); err != nil {
+			return false, err
+		}
+		return candidate.replayLSN >= target, nil
+	})
+}
+
+// checkFenceRoles refuses to fence the role standbys stream with: NOLOGIN
+// replicates, and the candidate could not reconnect to catch up
+func checkFenceRoles(candidate *node, replUser string, roles []string) error {
+	if replUser == "" {
+		if u, err := url.Parse(candidate.url); err == nil {
+			replUser = u.User.Username()
+		}
+	}
+	if slices.Contains(roles, replUser) {
+		return fmt.Errorf("-fence-roles must not include the replication user %q", replUser)
+	}
+	return nil
+}
+
+// waitStopped waits for a primary fenced without -fence-roles to go down
+func waitStopped(ctx context.Context, r *runner, primary *node, timeout time.Duration) error {
+	r.warn("fence", "read-only is best-effort without -fence-roles; stop the old primary now, promotion waits for it",
+		"node", primary.name)
+	return r.wait(ctx, "fence", primary.name+" to stop", timeout, func(ctx context.Context) (bool, error) {
+		return primaryStopped(ctx, primary.refresh(ctx), func(ctx context.Context) error {
+			conn, err := pgx.Connect(ctx, primary.url)
+			if err != nil {
+				return err
+			}
+			// the old connection broke while the server is up, keep polling on the new one
+			primary.conn.Close(ctx)
+			primary.conn = conn
+			return nil
+		}), nil
+	})
+}
+
+// primaryStopped tells whether refreshErr, the result of querying the primary, means
+// the server is down. Only a failed connection counts: a connect error or an admin
+// shutdown right away, any other error once a fresh connect fails too. A timeout of
+// the wait itself is not a stop.
+func primaryStopped(ctx context.Context, refreshErr error, connect func(context.Context) error) bool {
+	if refreshErr == nil || ctx.Err() != nil {
+		return false
+	}
+	if isConnectionFailure(refreshErr) {
+		return true
+	}
+	return connect(ctx) != nil && ctx.Err() == nil
+}
+
+func isConnectionFailure(err error) bool {
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "57P01" // admin_shutdown
+}
+
+func promote(ctx context.Context, r *runner, candidate *node, timeout time.Duration) error {
+	sql := fmt.Sprintf("SELECT pg_promote(true, %d)", max(int(timeout.Seconds()), 1))
+	if r.dryRun {
+		r.info("promote", "would execute", "node", candidate.name, "sql", sql, "dry_run", true)
+		return nil
+	}
+	var promoted bool
+	if err := candidate.conn.QueryRow(ctx, sql).Scan(&promoted); err != nil {
+		return fmt.Errorf("promote %s: %w", candidate.name, err)
+	}
+	if !promoted {
+		return fmt.Errorf("promote %s: %w", candidate.name, errWaitTimeout)
+	}
+	r.info("promote", "executed", "node", candidate.name, "sql", sql)
+	return nil
+}
+
+// repoint makes standbys (all reachable ones by default) stream from primary
+func repoint(ctx context.Context, r *runner, c *cluster, opts options, primaryName string, names []string) error {
+	c.inspect(ctx)
+	r.logTopology(c)
+
+	primary := c.node(primaryName)
+	if primary == nil || primary.role() == "down" {
+		return fmt.Errorf("primary %q is not a reachable node", primaryName)
+	}
+	if len(names) == 0 {
+		for _, n := range c.byRole("standby") {
+			if n != primary {
+				names = append(names, n.name)
+			}
+		}
+	}
+	return repointStandbys(ctx, r, c, opts, primary, names)
+}
+
+// repointStandbys sets primary_conninfo of the standbys and waits for them to stream
+func repointStandbys(ctx context.Context, r *runner, c *cluster, opts options, primary *node, names []string) error {
+	for _, name := range names {
+		n := c.node(name)
+		if n == nil || n.role() != "standby" {
+			return fmt.Errorf("%s is not a reachable standby", name)
+		}
+		conninfo, logged, err := primaryConninfo(primary, n, opts.replUser, opts.replPassword)
+		if err != nil {
+			return err
+		}
+		// primary_conninfo is reloadable since PostgreSQL 13, the WAL receiver reconnects;
+		// recovery_target_timeline = latest lets the standby follow the promotion
+		if err := r.setConfig(ctx, "repoint", n, "primary_conninfo", conninfo, logged); err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	return r.wait(ctx, "repoint", strings.Join(names, ", ")+" to stream from "+primary.name, opts.timeout,
+		func(ctx context.Context) (bool, error) {
+			rows, err := primary.replication(ctx)
+			if err != nil {
+				return false, err
+			}
+			for _, name := range names {
+				if !slices.ContainsFunc(rows, func(row replicationRow) bool {
+					return row.ApplicationName == name && row.State == "streaming"
+				}) {
+					return false, nil
+				}
+			}
+			return true, nil
+		})
+}
+
+// setSync turns synchronous replication of the primary on (with the given or
+// all streaming standbys) or off
+func setSync(ctx context.Context, r *runner, c *cluster, on bool, standbys []string, num int) error {
+	c.inspect(ctx)
+	r.logTopology(c)
+
+	primaries := c.byRole("primary")
+	if len(primaries) != 1 {
+		return fmt.Errorf("want exactly one primary, found %q", nodeNames(primaries))
+	}
+	primary := primaries[0]
+	if !on {
+		return r.setConfig(ctx, "sync-off", primary, "synchronous_standby_names", "", "")
+	}
+
+	if len(standbys) == 0 {
+		rows, err := primary.replication(ctx)
+		if err != nil {
+			return fmt.Errorf("pg_stat_replication on %s: %w", primary.name, err)
+		}
+		for _, row := range rows {
+			if row.State == "streaming" {
+				standbys = append(standbys, row.ApplicationName)
+			}
+		}
+		if len(standbys) == 0 {
+			return errors.New("no streaming standbys to make synchronous")
+		}
+	}
+	return enableSync(ctx, r, primary, standbys, num)
+}
+
+func enableSync(ctx context.Context, r *runner, primary *node, standbys []string, num int) error {
+	value, err := syncStandbyNames(standbys, num)
+	if err != nil {
+		return err
+	}
+	return r.setConfig(ctx, "sync-on", primary, "synchronous_standby_names", value, "")
+}
+
+// syncStandbyNames builds synchronous_standby_names: FIRST num of standbys
+func syncStandbyNames(standbys []string, num int) (string, error) {
+	if num < 1 || num > len(standbys) {
+		return "", fmt.Errorf("invalid -num %d for %d standbys", num, len(standbys))
+	}
+	quoted := make([]string, 0, len(standbys))
+	for _, name := range standbys {
+		quoted = append(quoted, quoteIdent(name))
+	}
+	return fmt.Sprintf("FIRST %d (%s)", num, strings.Join(quoted, ", ")), nil
+}
+
+func nodeNames(nodes []*node) string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,148 @@
+// Command pgctl manages the PostgreSQL cluster of the social network over SQL
+// only, so it works the same against the docker-compose cluster and against
+// plain local postgres processes:
+//
+//	pgctl status                          roles, WAL positions and pg_stat_replication
+//	pgctl failover [-switchover [-fence-roles a,b]] [-candidate name] [-sync auto|on|off]
+//	pgctl repoint -primary name [standby...]
+//	pgctl sync on|off [-standbys a,b] [-num 1]
+//
+// Nodes come from -nodes or PGCTL_NODES (DB_NODES of the monolith works too):
+// name=url,name=url. Node names are the standbys' application_name in
+// primary_conninfo and synchronous_standby_names. -replication-hosts gives the
+// host:port standbys stream from when it differs from the URL pgctl connects
+// to (e.g. localhost ports mapped by docker-compose). Every step is logged as
+// a structured record; -dry-run logs the statements instead of running them.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"social-network-common/env"
+)
+
+type options struct {
+	nodes        string
+	replHosts    string
+	replUser     string
+	replPassword string
+	dryRun       bool
+	timeout      time.Duration
+	logFormat    string
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+
+	var opts options
+	fs := flag.NewFlagSet("pgctl "+command, flag.ExitOnError)
+	fs.StringVar(&opts.nodes, "nodes", env.OrDefault("PGCTL_NODES", os.Getenv("DB_NODES")), "cluster nodes, name=url,name=url")
+	fs.StringVar(&opts.replHosts, "replication-hosts", os.Getenv("PGCTL_REPLICATION_HOSTS"), "host:port standbys stream from, name=host:port,... (default: host of the node URL)")
+	fs.StringVar(&opts.replUser, "replication-user", os.Getenv("PGCTL_REPLICATION_USER"), "user in primary_conninfo (default: user of the primary URL)")
+	fs.StringVar(&opts.replPassword, "replication-password", os.Getenv("PGCTL_REPLICATION_PASSWORD"), "password in primary_conninfo (default: password of the primary URL)")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "log the statements that change the cluster instead of running them")
+	fs.DurationVar(&opts.timeout, "timeout", 30*time.Second, "how long to wait for promotion, catch-up and standbys to connect")
+	fs.StringVar(&opts.logFormat, "log-format", "text", "text or json")
+
+	var run func(context.Context, *runner, *cluster) error
+	switch command {
+	case "status":
+		run = func(ctx context.Context, r *runner, c *cluster) error { return status(ctx, r, c) }
+	case "failover":
+		var f failoverOptions
+		fs.BoolVar(&f.switchover, "switchover", false, "the primary is up: fence it read-only and let the candidate catch up first")
+		fs.StringVar(&f.candidate, "candidate", "", "standby to promote (default: the most advanced by LSN)")
+		fs.StringVar(&f.sync, "sync", "auto", "synchronous replication on the new primary: auto (as before), on or off")
+		var fenceRoles string
+		fs.StringVar(&fenceRoles, "fence-roles", os.Getenv("PGCTL_FENCE_ROLES"), "application roles to lock out of the old primary with NOLOGIN on -switchover, a,b (default: none, the old primary must be stopped before promotion)")
+		run = func(ctx context.Context, r *runner, c *cluster) error {
+			f.options = opts
+			f.fenceRoles = splitNames(fenceRoles)
+			return failover(ctx, r, c, f)
+		}
+	case "repoint":
+		var primary string
+		fs.StringVar(&primary, "primary", "", "node to stream from")
+		run = func(ctx context.Context, r *runner, c *cluster) error {
+			return repoint(ctx, r, c, opts, primary, fs.Args())
+		}
+	case "sync":
+		var standbys string
+		var num int
+		fs.StringVar(&standbys, "standbys", "", "synchronous standbys, a,b (default: the streaming ones)")
+		fs.IntVar(&num, "num", 1, "how many of them must confirm a commit")
+		run = func(ctx context.Context, r *runner, c *cluster) error {
+			if fs.NArg() != 1 || (fs.Arg(0) != "on" && fs.Arg(0) != "off") {
+				return errors.New("usage: pgctl sync on|off")
+			}
+			return setSync(ctx, r, c, fs.Arg(0) == "on", splitNames(standbys), num)
+		}
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "pgctl: unknown command %q\n", command)
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	fs.Parse(args)
+
+	r := &runner{log: newLogger(opts.logFormat), dryRun: opts.dryRun}
+	c, err := loadCluster(opts.nodes, opts.replHosts)
+	if err != nil {
+		r.log.Error("invalid configuration", "error", err)
+		os.Exit(2)
+	}
+	defer c.close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, r, c); err != nil {
+		r.log.Error(command+" failed", "error", err)
+		c.close()
+		os.Exit(1)
+	}
+}
+
+func newLogger(format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, nil))
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `usage: pgctl <command> [flags]
+
+commands:
+  status     show node roles, WAL positions and replication health
+  failover   promote the most advanced standby and re-point the others to it
+  repoint    make standbys stream from another node
+  sync       turn synchronous replication on the primary on or off
+
+run "pgctl <command> -h" for the flags of a command
+`)
+}
+
+func splitNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
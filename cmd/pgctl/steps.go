@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var errWaitTimeout = errors.New("timed out")
+
+// runner carries out the steps of a command and logs each of them as a
+// structured record with the step name and node. With dryRun the statements
+// that change the cluster and the waits for their effect are only logged;
+// reading the cluster state still happens.
+type runner struct {
+	log    *slog.Logger
+	dryRun bool
+}
+
+func (r *runner) info(step, msg string, attrs ...any) {
+	r.log.Info(msg, append([]any{"step", step}, attrs...)...)
+}
+
+func (r *runner) warn(step, msg string, attrs ...any) {
+	r.log.Warn(msg, append([]any{"step", step}, attrs...)...)
+}
+
+// exec runs a statement that changes the cluster; logged replaces sql in the
+// log when the statement carries a secret
+func (r *runner) exec(ctx context.Context, step string, n *node, sql, logged string) error {
+	if logged == "" {
+		logged = sql
+	}
+	if r.dryRun {
+		r.info(step, "would execute", "node", n.name, "sql", logged, "dry_run", true)
+		return nil
+	}
+	start := time.Now()
+	if _, err := n.conn.Exec(ctx, sql); err != nil {
+		r.log.Error("statement failed", "step", step, "node", n.name, "sql", logged, "error", err)
+		return fmt.Errorf("%s on %s: %w", step, n.name, err)
+	}
+	r.info(step, "executed", "node", n.name, "sql", logged, "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// setConfig changes a parameter with ALTER SYSTEM and reloads the configuration
+func (r *runner) setConfig(ctx context.Context, step string, n *node, param, value, logged string) error {
+	sql := fmt.Sprintf("ALTER SYSTEM SET %s = %s", param, quoteLiteral(value))
+	if logged != "" {
+		logged = fmt.Sprintf("ALTER SYSTEM SET %s = %s", param, quoteLiteral(logged))
+	}
+	if err := r.exec(ctx, step, n, sql, logged); err != nil {
+		return err
+	}
+	return r.exec(ctx, step, n, "SELECT pg_reload_conf()", "")
+}
+
+// wait polls done every 500ms until it reports true or timeout passes
+func (r *runner) wait(ctx context.Context, step, what string, timeout time.Duration, done func(context.Context) (bool, error)) error {
+	if r.dryRun {
+		r.info(step, "would wait for "+what, "timeout", timeout, "dry_run", true)
+		return nil
+	}
+	r.info(step, "waiting for "+what, "timeout", timeout)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		ok, err := done(ctx)
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("%s: %w", step, err)
+		}
+		if ok {
+			r.info(step, what+" done", "duration", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: waiting for %s: %w", step, what, errWaitTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *runner) logTopology(c *cluster) {
+	for _, n := range c.nodes {
+		attrs := []any{"node", n.name, "role", n.role()}
+		if n.err != nil {
+			attrs = append(attrs, "error", n.err)
+		} else {
+			attrs = append(attrs, "receive_lsn", n.receiveLSN.String(), "replay_lsn", n.replayLSN.String())
+			if !n.inRecovery {
+				attrs = append(attrs, "synchronous_standby_names", n.syncNames)
+			}
+		}
+		r.info("inspect", "node", attrs...)
+	}
+}
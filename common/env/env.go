@@ -0,0 +1,37 @@
+// Package env reads configuration from environment variables
+package env
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// OrDefault returns the variable name or def if it is unset or empty
+func OrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// ParseList parses "name=value,name=value" lists such as READ_REPLICAS or
+// PGCTL_NODES; empty entries are skipped, a name must not contain "/"
+func ParseList(list string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || value == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid entry %q, want name=value", entry)
+		}
+		if _, dup := result[name]; dup {
+			return nil, fmt.Errorf("duplicate %q", name)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
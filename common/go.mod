@@ -0,0 +1,5 @@
+module social-network-common
+
+go 1.23.0
+
+require github.com/golang-jwt/jwt/v5 v5.1.0
@@ -0,0 +1,97 @@
+// Package jwtkeys holds the JWT key handling shared by the monolith, which
+// signs access tokens, and dialog-service, which only verifies them. Keys are
+// addressed by kid: "kid:secret,kid:secret" for HMAC and "kid:/path.pem,..."
+// for RSA.
+package jwtkeys
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// InsecureDevEnv set to 1 lets a service start without keys, using a secret
+// that is published in this repository. Anyone can sign tokens with it, so it
+// is for local runs only.
+const InsecureDevEnv = "JWT_INSECURE_DEV"
+
+const (
+	devKid    = "dev"
+	devSecret = "dev-insecure-secret"
+)
+
+// ErrNoKeys is returned by DevKey when no keys are configured and the
+// development key is not enabled
+var ErrNoKeys = errors.New("no JWT keys configured, set JWT_HMAC_KEYS or the RSA keys (" + InsecureDevEnv + "=1 for a local run)")
+
+// DevKey returns the development HMAC key if JWT_INSECURE_DEV=1 and ErrNoKeys otherwise
+func DevKey() (string, []byte, error) {
+	if os.Getenv(InsecureDevEnv) != "1" {
+		return "", nil, ErrNoKeys
+	}
+	log.Printf("WARNING: %s=1, using the insecure development JWT key", InsecureDevEnv)
+	return devKid, []byte(devSecret), nil
+}
+
+// SplitKeyList parses "kid:value,kid:value" into pairs
+func SplitKeyList(s string) [][2]string {
+	var out [][2]string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kid, value, ok := strings.Cut(item, ":")
+		if !ok || kid == "" || value == "" {
+			log.Printf("Skipping malformed JWT key entry %q", item)
+			continue
+		}
+		out = append(out, [2]string{kid, value})
+	}
+	return out
+}
+
+// LoadRSAPublicKeys reads "kid:/path/public.pem,..." into keys
+func LoadRSAPublicKeys(list string, keys map[string]any) error {
+	for _, kv := range SplitKeyList(list) {
+		pemBytes, err := os.ReadFile(kv[1])
+		if err != nil {
+			return fmt.Errorf("read public key %s: %w", kv[0], err)
+		}
+		pub, err := jwt.ParseRSAPublicKeyFromPEM(pemBytes)
+		if err != nil {
+			return fmt.Errorf("parse public key %s: %w", kv[0], err)
+		}
+		keys[kv[0]] = pub
+	}
+	return nil
+}
+
+// KeyFunc picks the verification key by kid and makes sure the token's alg
+// matches the key type, so an RSA public key is never used as an HMAC secret.
+// keys maps kid to []byte or *rsa.PublicKey.
+func KeyFunc(keys map[string]any) jwt.Keyfunc {
+	return func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		switch key.(type) {
+		case []byte:
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("kid %q expects HMAC, got %s", kid, t.Method.Alg())
+			}
+		case *rsa.PublicKey:
+			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("kid %q expects RSA, got %s", kid, t.Method.Alg())
+			}
+		}
+		return key, nil
+	}
+}
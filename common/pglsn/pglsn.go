@@ -0,0 +1,49 @@
+// Package pglsn handles PostgreSQL WAL positions (pg_lsn)
+package pglsn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LSN is a WAL position, scanned from its text form "16/B374D848"
+type LSN uint64
+
+func Parse(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	return LSN(h<<32 | l), nil
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint64(l)>>32, uint64(l)&0xFFFFFFFF)
+}
+
+// Scan reads the text form; NULL (e.g. pg_last_wal_receive_lsn() on a primary) is 0
+func (l *LSN) Scan(src any) error {
+	if src == nil {
+		*l = 0
+		return nil
+	}
+	s, ok := src.(string)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into LSN", src)
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
@@ -0,0 +1,33 @@
+package pglsn
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want LSN
+	}{
+		{"0/0", 0},
+		{"0/16B3748", 0x16B3748},
+		{"16/B374D848", 0x16B374D848},
+		{"FFFFFFFF/FFFFFFFF", 0xFFFFFFFFFFFFFFFF},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("Parse(%q) = %X, want %X", tt.in, uint64(got), uint64(tt.want))
+		}
+		if got.String() != tt.in {
+			t.Fatalf("String() = %q, want %q", got.String(), tt.in)
+		}
+	}
+
+	for _, in := range []string{"", "16", "16/", "/B374D848", "G/0", "100000000/0", "0/100000000"} {
+		if _, err := Parse(in); err == nil {
+			t.Fatalf("Parse(%q) succeeded", in)
+		}
+	}
+}
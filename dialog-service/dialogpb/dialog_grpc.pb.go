@@ -0,0 +1,261 @@
+// gRPC API Dialog Service. Сгенерированный код лежит в dialog-service/dialogpb
+// и monolith/dialogpb:
+//
+//   protoc -I dialog-service/proto \
+//     --go_out=dialog-service/dialogpb --go_opt=paths=source_relative \
+//     --go-grpc_out=dialog-service/dialogpb --go-grpc_opt=paths=source_relative \
+//     dialog.proto
+//
+// (то же для monolith/dialogpb с --go_opt=Mdialog.proto=social-network-monolith/dialogpb
+// и --go-grpc_opt=Mdialog.proto=social-network-monolith/dialogpb).
+//
+// Вызывающий передает в метаданных authorization ("Bearer <JWT>" монолита) и
+// x-request-id; беседа - личный диалог с user_id или группа group_id.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: dialog.proto
+
+package dialogpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	DialogService_Send_FullMethodName        = "/dialog.v1.DialogService/Send"
+	DialogService_List_FullMethodName        = "/dialog.v1.DialogService/List"
+	DialogService_ListDialogs_FullMethodName = "/dialog.v1.DialogService/ListDialogs"
+	DialogService_Stream_FullMethodName      = "/dialog.v1.DialogService/Stream"
+)
+
+// DialogServiceClient is the client API for DialogService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DialogServiceClient interface {
+	// Send сохраняет сообщение; повтор с тем же client_message_id возвращает сохраненное ранее
+	Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	// List возвращает страницу истории и сдвигает курсор прочтения
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// ListDialogs возвращает беседы пользователя, самые активные первыми
+	ListDialogs(ctx context.Context, in *ListDialogsRequest, opts ...grpc.CallOption) (*ListDialogsResponse, error)
+	// Stream отдает сообщения беседы новее after, затем новые по мере отправки
+	Stream(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Message], error)
+}
+
+type dialogServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDialogServiceClient(cc grpc.ClientConnInterface) DialogServiceClient {
+	return &dialogServiceClient{cc}
+}
+
+func (c *dialogServiceClient) Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, DialogService_Send_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dialogServiceClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, DialogService_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dialogServiceClient) ListDialogs(ctx context.Context, in *ListDialogsRequest, opts ...grpc.CallOption) (*ListDialogsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListDialogsResponse)
+	err := c.cc.Invoke(ctx, DialogService_ListDialogs_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dialogServiceClient) Stream(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Message], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &DialogService_ServiceDesc.Streams[0], DialogService_Stream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamRequest, Message]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type DialogService_StreamClient = grpc.ServerStreamingClient[Message]
+
+// DialogServiceServer is the server API for DialogService service.
+// All implementations must embed UnimplementedDialogServiceServer
+// for forward compatibility.
+type DialogServiceServer interface {
+	// Send сохраняет сообщение; повтор с тем же client_message_id возвращает сохраненное ранее
+	Send(context.Context, *SendRequest) (*SendResponse, error)
+	// List возвращает страницу истории и сдвигает курсор прочтения
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// ListDialogs возвращает беседы пользователя, самые активные первыми
+	ListDialogs(context.Context, *ListDialogsRequest) (*ListDialogsResponse, error)
+	// Stream отдает сообщения беседы новее after, затем новые по мере отправки
+	Stream(*StreamRequest, grpc.ServerStreamingServer[Message]) error
+	mustEmbedUnimplementedDialogServiceServer()
+}
+
+// UnimplementedDialogServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedDialogServiceServer struct{}
+
+func (UnimplementedDialogServiceServer) Send(context.Context, *SendRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
+}
+func (UnimplementedDialogServiceServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedDialogServiceServer) ListDialogs(context.Context, *ListDialogsRequest) (*ListDialogsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDialogs not implemented")
+}
+func (UnimplementedDialogServiceServer) Stream(*StreamRequest, grpc.ServerStreamingServer[Message]) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedDialogServiceServer) mustEmbedUnimplementedDialogServiceServer() {}
+func (UnimplementedDialogServiceServer) testEmbeddedByValue()                       {}
+
+// UnsafeDialogServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DialogServiceServer will
+// result in compilation errors.
+type UnsafeDialogServiceServer interface {
+	mustEmbedUnimplementedDialogServiceServer()
+}
+
+func RegisterDialogServiceServer(s grpc.ServiceRegistrar, srv DialogServiceServer) {
+	// If the following call pancis, it indicates UnimplementedDialogServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&DialogService_ServiceDesc, srv)
+}
+
+func _DialogService_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DialogServiceServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DialogService_Send_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DialogServiceServer).Send(ctx, req.(*SendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DialogService_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DialogServiceServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DialogService_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DialogServiceServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DialogService_ListDialogs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDialogsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DialogServiceServer).ListDialogs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DialogService_ListDialogs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DialogServiceServer).ListDialogs(ctx, req.(*ListDialogsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DialogService_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DialogServiceServer).Stream(m, &grpc.GenericServerStream[StreamRequest, Message]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type DialogService_StreamServer = grpc.ServerStreamingServer[Message]
+
+// DialogService_ServiceDesc is the grpc.ServiceDesc for DialogService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DialogService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dialog.v1.DialogService",
+	HandlerType: (*DialogServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    _DialogService_Send_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _DialogService_List_Handler,
+		},
+		{
+			MethodName: "ListDialogs",
+			Handler:    _DialogService_ListDialogs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _DialogService_Stream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "dialog.proto",
+}
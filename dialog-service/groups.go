@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Групповые чаты. Группа - беседа, ключ которой ID группы (UUIDv7) вместо
+// createDialogKey, поэтому сообщения, курсоры прочтения, счетчики и шардирование
+// работают для групп так же, как для личных диалогов. Личный диалог - беседа
+// из двух участников без ролей.
+const (
+	roleAdmin  = "admin"
+	roleMember = "member"
+
+	maxGroupMembers = 1000
+)
+
+type GroupMember struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type Group struct {
+	ID        string        `json:"id"`
+	Title     string        `json:"title"`
+	CreatedBy string        `json:"created_by"`
+	CreatedAt time.Time     `json:"created_at"`
+	Members   []GroupMember `json:"members"`
+}
+
+func (g *Group) Member(userId string) *GroupMember {
+	for i := range g.Members {
+		if g.Members[i].UserID == userId {
+			return &g.Members[i]
+		}
+	}
+	return nil
+}
+
+func (g *Group) admins() int {
+	n := 0
+	for _, m := range g.Members {
+		if m.Role == roleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// Проверки состава группы. Хранилище вызывает их под блокировкой группы вместе
+// с изменением, чтобы одновременные запросы не оставили группу без
+// администратора, не превысили maxGroupMembers и не прошли от имени
+// администратора, которого только что разжаловали или удалили. actorId -
+// пользователь, выполняющий изменение.
+
+// checkAdmin - управлять участниками могут только администраторы группы
+func (g *Group) checkAdmin(actorId string) error {
+	if m := g.Member(actorId); m == nil || m.Role != roleAdmin {
+		return errNotGroupAdmin
+	}
+	return nil
+}
+
+func (g *Group) checkAdd(actorId, userId string) error {
+	if err := g.checkAdmin(actorId); err != nil {
+		return err
+	}
+	if g.Member(userId) != nil {
+		return errAlreadyMember
+	}
+	if len(g.Members) >= maxGroupMembers {
+		return errGroupFull
+	}
+	return nil
+}
+
+// checkRemove: администратор удаляет любого участника, участник может выйти сам
+func (g *Group) checkRemove(actorId, userId string) error {
+	if actorId != userId {
+		if err := g.checkAdmin(actorId); err != nil {
+			return err
+		}
+	}
+	member := g.Member(userId)
+	if member == nil {
+		return errNotMember
+	}
+	if member.Role == roleAdmin && g.admins() == 1 && len(g.Members) > 1 {
+		return errLastAdmin
+	}
+	return nil
+}
+
+func (g *Group) checkSetRole(actorId, userId, role string) error {
+	if err := g.checkAdmin(actorId); err != nil {
+		return err
+	}
+	member := g.Member(userId)
+	if member == nil {
+		return errNotMember
+	}
+	if member.Role == roleAdmin && role != roleAdmin && g.admins() == 1 {
+		return errLastAdmin
+	}
+	return nil
+}
+
+func (g *Group) clone() *Group {
+	c := *g
+	c.Members = slices.Clone(g.Members)
+	return &c
+}
+
+// isGroupKey отличает ID группы от ключа личного диалога "<user1>_<user2>"
+func isGroupKey(dialogKey string) bool {
+	return !strings.Contains(dialogKey, "_")
+}
+
+func conversationKind(dialogKey string) string {
+	if isGroupKey(dialogKey) {
+		return "group"
+	}
+	return "direct"
+}
+
+type GroupCreateRequest struct {
+	Title   string   `json:"title" binding:"required"`
+	Members []string `json:"members"`
+}
+
+type GroupMemberRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+	Role   string `json:"role"`
+}
+
+type GroupRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// directConversation - личный диалог с :user_id
+func directConversation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		peerId := c.Param("user_id")
+		if strings.Contains(peerId, "_") {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid user ID"})
+			c.Abort()
+			return
+		}
+		c.Set("dialogKey", createDialogKey(c.GetString("userId"), peerId))
+		c.Next()
+	}
+}
+
+// groupConversation пускает к группе :group_id только ее участников
+func groupConversation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupId := c.Param("group_id")
+		group, err := memberGroup(c.Request.Context(), groupId, c.GetString("userId"))
+		switch {
+		case errors.Is(err, errConversationNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+			c.Abort()
+			return
+		case errors.Is(err, errNotMember):
+			c.JSON(http.StatusForbidden, gin.H{"message": "You are not a member of this group"})
+			c.Abort()
+			return
+		case err != nil:
+			log.Printf("Failed to load group %s: %v", groupId, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to load group"})
+			c.Abort()
+			return
+		}
+
+		c.Set("dialogKey", group.ID)
+		c.Set("group", group)
+		c.Next()
+	}
+}
+
+// memberGroup загружает группу, если userId - ее участник
+func memberGroup(ctx context.Context, groupId, userId string) (*Group, error) {
+	if uuid.Validate(groupId) != nil {
+		return nil, errConversationNotFound
+	}
+	group, err := storage.Group(ctx, groupId)
+	if err != nil {
+		return nil, err
+	}
+	if group.Member(userId) == nil {
+		return nil, errNotMember
+	}
+	return group, nil
+}
+
+func createGroup(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+
+	var req GroupCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request data"})
+		return
+	}
+
+	groupId, err := uuid.NewV7()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate group ID"})
+		return
+	}
+
+	group := &Group{
+		ID:        groupId.String(),
+		Title:     req.Title,
+		CreatedBy: currentUserId,
+		CreatedAt: time.Now(),
+		Members:   []GroupMember{{UserID: currentUserId, Role: roleAdmin}},
+	}
+	for _, userId := range req.Members {
+		if userId == "" || strings.Contains(userId, "_") || group.Member(userId) != nil {
+			continue
+		}
+		group.Members = append(group.Members, GroupMember{UserID: userId, Role: roleMember})
+	}
+	if len(group.Members) > maxGroupMembers {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Too many group members"})
+		return
+	}
+
+	if err := storage.CreateGroup(c.Request.Context(), group); err != nil {
+		log.Printf("Failed to create group: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create group"})
+		return
+	}
+
+	log.Printf("Group %s created by %s with %d members", group.ID, currentUserId, len(group.Members))
+	c.JSON(http.StatusOK, group)
+}
+
+func getGroup(c *gin.Context) {
+	c.JSON(http.StatusOK, c.MustGet("group"))
+}
+
+// Права администратора проверяет хранилище под блокировкой группы: снимок
+// группы из groupConversation к этому моменту мог устареть
+
+func addGroupMember(c *gin.Context) {
+	group := c.MustGet("group").(*Group)
+
+	var req GroupMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.Contains(req.UserID, "_") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request data"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleMember
+	}
+	if req.Role != roleAdmin && req.Role != roleMember {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Role must be admin or member"})
+		return
+	}
+
+	err := storage.AddMember(c.Request.Context(), group.ID, c.GetString("userId"), GroupMember{UserID: req.UserID, Role: req.Role})
+	if err != nil {
+		respondGroupError(c, "add member to", group.ID, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member added"})
+}
+
+// removeGroupMember: администратор удаляет любого участника, участник может выйти сам
+func removeGroupMember(c *gin.Context) {
+	group := c.MustGet("group").(*Group)
+	memberId := c.Param("member_id")
+
+	if err := storage.RemoveMember(c.Request.Context(), group.ID, c.GetString("userId"), memberId); err != nil {
+		respondGroupError(c, "remove member from", group.ID, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+func setGroupMemberRole(c *gin.Context) {
+	group := c.MustGet("group").(*Group)
+	memberId := c.Param("member_id")
+
+	var req GroupRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Role != roleAdmin && req.Role != roleMember) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Role must be admin or member"})
+		return
+	}
+	if err := storage.SetMemberRole(c.Request.Context(), group.ID, c.GetString("userId"), memberId, req.Role); err != nil {
+		respondGroupError(c, "change member role in", group.ID, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member role updated"})
+}
+
+func respondGroupError(c *gin.Context, action, groupId string, err error) {
+	switch {
+	case errors.Is(err, errConversationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+	case errors.Is(err, errNotGroupAdmin):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only group admins can manage members"})
+	case errors.Is(err, errNotMember):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Member not found"})
+	case errors.Is(err, errAlreadyMember):
+		c.JSON(http.StatusConflict, gin.H{"message": "User is already a member"})
+	case errors.Is(err, errGroupFull):
+		c.JSON(http.StatusConflict, gin.H{"message": "Group is full"})
+	case errors.Is(err, errLastAdmin):
+		c.JSON(http.StatusConflict, gin.H{"message": "Group must keep at least one admin"})
+	default:
+		log.Printf("Failed to %s group %s: %v", action, groupId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to " + action + " group"})
+	}
+}
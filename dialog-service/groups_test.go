@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestGroupKeepsLastAdmin(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	group := &Group{ID: "group", Members: []GroupMember{
+		{UserID: "a", Role: roleAdmin},
+		{UserID: "b", Role: roleAdmin},
+		{UserID: "c", Role: roleMember},
+	}}
+	if err := store.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+
+	// два администратора одновременно снимают роль с себя: проходит только один
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, userId := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = store.SetMemberRole(ctx, group.ID, userId, userId, roleMember)
+		}()
+	}
+	wg.Wait()
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Fatalf("errs = %v, want exactly one errLastAdmin", errs)
+	}
+
+	stored, err := store.Group(ctx, group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.admins() != 1 {
+		t.Fatalf("%d admins left, want 1", stored.admins())
+	}
+	var admin string
+	for _, m := range stored.Members {
+		if m.Role == roleAdmin {
+			admin = m.UserID
+		}
+	}
+	if err := store.RemoveMember(ctx, group.ID, admin, admin); !errors.Is(err, errLastAdmin) {
+		t.Fatalf("removing the last admin: err = %v, want errLastAdmin", err)
+	}
+}
+
+func TestGroupMemberLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	group := &Group{ID: "group", Members: []GroupMember{{UserID: "admin", Role: roleAdmin}}}
+	if err := store.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxGroupMembers+10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.AddMember(ctx, group.ID, "admin", GroupMember{UserID: fmt.Sprintf("user-%d", i), Role: roleMember})
+			if err != nil && !errors.Is(err, errGroupFull) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored, err := store.Group(ctx, group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Members) != maxGroupMembers {
+		t.Fatalf("%d members, want %d", len(stored.Members), maxGroupMembers)
+	}
+}
+
+func TestGroupChecksActorRole(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	group := &Group{ID: "group", Members: []GroupMember{
+		{UserID: "a", Role: roleAdmin},
+		{UserID: "b", Role: roleAdmin},
+		{UserID: "c", Role: roleMember},
+		{UserID: "d", Role: roleMember},
+	}}
+	if err := store.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	// b разжалован после того, как его запрос загрузил группу
+	if err := store.SetMemberRole(ctx, group.ID, "a", "b", roleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func() error
+		wantErr error
+	}{
+		{"demoted admin adds", func() error {
+			return store.AddMember(ctx, group.ID, "b", GroupMember{UserID: "e", Role: roleMember})
+		}, errNotGroupAdmin},
+		{"demoted admin promotes themselves", func() error { return store.SetMemberRole(ctx, group.ID, "b", "b", roleAdmin) }, errNotGroupAdmin},
+		{"member removes another", func() error { return store.RemoveMember(ctx, group.ID, "c", "d") }, errNotGroupAdmin},
+		{"outsider removes a member", func() error { return store.RemoveMember(ctx, group.ID, "x", "d") }, errNotGroupAdmin},
+		{"member leaves", func() error { return store.RemoveMember(ctx, group.ID, "c", "c") }, nil},
+		{"admin removes a member", func() error { return store.RemoveMember(ctx, group.ID, "a", "d") }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	stored, err := store.Group(ctx, group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(stored.Members); got != 2 || stored.Member("b").Role != roleMember {
+		t.Fatalf("members = %+v, want a (admin) and b (member)", stored.Members)
+	}
+}
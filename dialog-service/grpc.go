@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"dialog-service/dialogpb"
+)
+
+// gRPC API (proto/dialog.proto) на GRPC_PORT (9081) рядом с HTTP. Логика общая
+// с HTTP-обработчиками, метаданные authorization и x-request-id - аналог
+// заголовков Authorization и X-Request-ID.
+const streamPollInterval = 2 * time.Second
+
+type userIdContextKey struct{}
+
+type dialogServer struct {
+	dialogpb.UnimplementedDialogServiceServer
+}
+
+func serveGRPC(port string) {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("Failed to listen on gRPC port %s: %v", port, err)
+	}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryAuth),
+		grpc.ChainStreamInterceptor(grpcStreamAuth),
+	)
+	dialogpb.RegisterDialogServiceServer(srv, &dialogServer{})
+
+	log.Printf("Dialog Service gRPC starting on port %s", port)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatalf("gRPC server failed: %v", err)
+	}
+}
+
+// grpcAuthenticate проверяет JWT из метаданных так же, как userContextMiddleware
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "Authorization metadata required")
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Invalid authorization format")
+	}
+	userId, err := jwtKeys.Verify(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	return context.WithValue(ctx, userIdContextKey{}, userId), nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context { return s.ctx }
+
+func grpcStreamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+func grpcUserId(ctx context.Context) string {
+	userId, _ := ctx.Value(userIdContextKey{}).(string)
+	return userId
+}
+
+func grpcRequestId(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("x-request-id"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// conversationKey находит беседу запроса, как directConversation/groupConversation
+func conversationKey(ctx context.Context, userId string, conv *dialogpb.Conversation) (string, error) {
+	switch kind := conv.GetKind().(type) {
+	case *dialogpb.Conversation_UserId:
+		if kind.UserId == "" || strings.Contains(kind.UserId, "_") {
+			return "", status.Error(codes.InvalidArgument, "Invalid user ID")
+		}
+		return createDialogKey(userId, kind.UserId), nil
+	case *dialogpb.Conversation_GroupId:
+		group, err := memberGroup(ctx, kind.GroupId, userId)
+		switch {
+		case errors.Is(err, errConversationNotFound):
+			return "", status.Error(codes.NotFound, "Group not found")
+		case errors.Is(err, errNotMember):
+			return "", status.Error(codes.PermissionDenied, "You are not a member of this group")
+		case err != nil:
+			log.Printf("Failed to load group %s: %v", kind.GroupId, err)
+			return "", status.Error(codes.Internal, "Failed to load group")
+		}
+		return group.ID, nil
+	default:
+		return "", status.Error(codes.InvalidArgument, "Conversation is required")
+	}
+}
+
+func (s *dialogServer) Send(ctx context.Context, req *dialogpb.SendRequest) (*dialogpb.SendResponse, error) {
+	userId := grpcUserId(ctx)
+	if req.GetConversation().GetUserId() == userId {
+		return nil, status.Error(codes.InvalidArgument, "Cannot send message to yourself")
+	}
+	if req.Text == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid request data")
+	}
+	if len(req.ClientMessageId) > maxIdempotencyKeyLength {
+		return nil, status.Error(codes.InvalidArgument, "Idempotency key is too long")
+	}
+	dialogKey, err := conversationKey(ctx, userId, req.Conversation)
+	if err != nil {
+		return nil, err
+	}
+
+	message, replayed, err := sendToConversation(ctx, dialogKey, userId, req.Text, req.ClientMessageId)
+	switch {
+	case errors.Is(err, errNotMember):
+		return nil, status.Error(codes.PermissionDenied, "You are not a member of this conversation")
+	case errors.Is(err, errMessageNotFound):
+		return nil, status.Error(codes.FailedPrecondition, "Message sent with this idempotency key has been deleted")
+	case err != nil:
+		log.Printf("Failed to store message: %v", err)
+		return nil, status.Error(codes.Internal, "Failed to store message")
+	}
+
+	if replayed {
+		log.Printf("Replayed message %s from %s to %s (request %s)", message.ID, userId, dialogKey, grpcRequestId(ctx))
+	} else {
+		log.Printf("Message sent from %s to %s: %s (request %s)", userId, dialogKey, req.Text, grpcRequestId(ctx))
+	}
+	return &dialogpb.SendResponse{Message: toProtoMessage(message), Replayed: replayed}, nil
+}
+
+func (s *dialogServer) List(ctx context.Context, req *dialogpb.ListRequest) (*dialogpb.ListResponse, error) {
+	userId := grpcUserId(ctx)
+	q, ok := newListQuery(req.Before, req.After, int(req.Limit))
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Invalid before, after or limit")
+	}
+	dialogKey, err := conversationKey(ctx, userId, req.Conversation)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := readConversation(ctx, dialogKey, userId, q)
+	if err != nil {
+		log.Printf("Failed to load dialog %s: %v", dialogKey, err)
+		return nil, status.Error(codes.Internal, "Failed to load dialog")
+	}
+	resp := &dialogpb.ListResponse{Messages: make([]*dialogpb.Message, 0, len(messages))}
+	for _, m := range messages {
+		resp.Messages = append(resp.Messages, toProtoMessage(m))
+	}
+	return resp, nil
+}
+
+func (s *dialogServer) ListDialogs(ctx context.Context, req *dialogpb.ListDialogsRequest) (*dialogpb.ListDialogsResponse, error) {
+	userId := grpcUserId(ctx)
+	q, ok := newDialogsQuery(req.Before, int(req.Limit))
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Invalid before or limit")
+	}
+
+	dialogs, err := storage.UserDialogs(ctx, userId, q)
+	if err != nil {
+		log.Printf("Failed to load dialogs of %s: %v", userId, err)
+		return nil, status.Error(codes.Internal, "Failed to load dialogs")
+	}
+	resp := &dialogpb.ListDialogsResponse{Dialogs: make([]*dialogpb.DialogSummary, 0, len(dialogs))}
+	for _, d := range dialogs {
+		resp.Dialogs = append(resp.Dialogs, &dialogpb.DialogSummary{
+			ConversationId:     d.DialogKey,
+			Kind:               d.Kind,
+			UserId:             d.PeerID,
+			Title:              d.Title,
+			LastMessageId:      d.LastMessageID,
+			LastMessageFrom:    d.LastMessageFrom,
+			LastMessagePreview: d.LastMessageText,
+			LastMessageAt:      timestamppb.New(d.LastMessageAt),
+			Unread:             int32(d.Unread),
+		})
+	}
+	return resp, nil
+}
+
+// Stream отдает сообщения после after (без after - только новые) и ждет следующих.
+// Поток читает историю, только когда его будит newMessages: сразу при отправке
+// через этот экземпляр или по опросу беседы раз в streamPollInterval (один на
+// беседу, см. messageHub). Заголовки уходят сразу, по ним клиент видит, что поток открыт.
+func (s *dialogServer) Stream(req *dialogpb.StreamRequest, stream dialogpb.DialogService_StreamServer) error {
+	ctx := stream.Context()
+	userId := grpcUserId(ctx)
+	if req.After != "" && uuid.Validate(req.After) != nil {
+		return status.Error(codes.InvalidArgument, "Invalid after")
+	}
+	dialogKey, err := conversationKey(ctx, userId, req.Conversation)
+	if err != nil {
+		return err
+	}
+
+	wake := newMessages.subscribe(dialogKey)
+	defer newMessages.unsubscribe(dialogKey, wake)
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	after := req.After
+	if after == "" {
+		last, err := storage.List(ctx, dialogKey, ListQuery{Limit: 1, Viewer: userId})
+		if err != nil {
+			return status.Error(codes.Internal, "Failed to load dialog")
+		}
+		if len(last) > 0 {
+			after = last[0].ID
+		}
+	}
+
+	for {
+		messages, err := storage.List(ctx, dialogKey, ListQuery{After: after, Limit: maxPageLimit, Viewer: userId})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("Failed to stream dialog %s: %v", dialogKey, err)
+			return status.Error(codes.Internal, "Failed to load dialog")
+		}
+		for _, m := range messages {
+			if err := stream.Send(toProtoMessage(m)); err != nil {
+				return err
+			}
+			after = m.ID
+		}
+		if len(messages) == maxPageLimit {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		}
+	}
+}
+
+func toProtoMessage(m *DialogMessage) *dialogpb.Message {
+	pm := &dialogpb.Message{
+		Id:             m.ID,
+		ConversationId: m.ConversationID,
+		From:           m.From,
+		Text:           m.Text,
+		Timestamp:      timestamppb.New(m.Timestamp),
+		Edited:         m.Edited,
+	}
+	if m.EditedAt != nil {
+		pm.EditedAt = timestamppb.New(*m.EditedAt)
+	}
+	return pm
+}
+
+// messageHub будит потоки Stream беседы, когда в ней появилось сообщение: сразу
+// при отправке через этот экземпляр (publish) и по опросу для отправленных через
+// другие. Опрос один на беседу, пока ее ждет хотя бы один поток, так что нагрузка
+// на хранилище не растет с числом потоков.
+type messageHub struct {
+	mu     sync.Mutex
+	topics map[string]*hubTopic // dialog key -> subscribers
+}
+
+type hubTopic struct {
+	subs     map[chan struct{}]struct{}
+	stopPoll context.CancelFunc
+}
+
+var newMessages = &messageHub{topics: make(map[string]*hubTopic)}
+
+func (h *messageHub) subscribe(dialogKey string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	topic := h.topics[dialogKey]
+	if topic == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		topic = &hubTopic{subs: make(map[chan struct{}]struct{}), stopPoll: cancel}
+		h.topics[dialogKey] = topic
+		go h.poll(ctx, dialogKey)
+	}
+	topic.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *messageHub) unsubscribe(dialogKey string, ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	topic := h.topics[dialogKey]
+	if topic == nil {
+		return
+	}
+	delete(topic.subs, ch)
+	if len(topic.subs) == 0 {
+		topic.stopPoll()
+		delete(h.topics, dialogKey)
+	}
+}
+
+// publish не блокируется: подписчик, который еще не проснулся, уже получил сигнал
+func (h *messageHub) publish(dialogKey string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if topic := h.topics[dialogKey]; topic != nil {
+		for ch := range topic.subs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// poll раз в streamPollInterval читает ID последнего сообщения беседы и будит
+// потоки, когда он меняется. Первое прочитанное значение тоже будит: сообщение
+// могло прийти между подпиской потока и первым опросом.
+func (h *messageHub) poll(ctx context.Context, dialogKey string) {
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	var last string
+	for {
+		messages, err := storage.List(ctx, dialogKey, ListQuery{Limit: 1})
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Failed to poll dialog %s: %v", dialogKey, err)
+		case len(messages) > 0 && messages[0].ID != last:
+			last = messages[0].ID
+			h.publish(dialogKey)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMessageHubPollsOncePerConversation(t *testing.T) {
+	storage = newMemoryStore()
+
+	dialogKey := createDialogKey("a", "b")
+	// сообщение, отправленное "через другой экземпляр": без publish
+	if _, err := storage.Append(context.Background(), dialogKey, &DialogMessage{From: "a", Text: "hi"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := &messageHub{topics: make(map[string]*hubTopic)}
+	first := hub.subscribe(dialogKey)
+	second := hub.subscribe(dialogKey)
+	if len(hub.topics) != 1 {
+		t.Fatalf("%d topics, want 1", len(hub.topics))
+	}
+	for _, wake := range []chan struct{}{first, second} {
+		select {
+		case <-wake:
+		case <-time.After(time.Second):
+			t.Fatal("the poll did not wake a subscriber")
+		}
+	}
+
+	hub.unsubscribe(dialogKey, first)
+	hub.unsubscribe(dialogKey, second)
+	if len(hub.topics) != 0 {
+		t.Fatalf("the topic is kept after the last subscriber left")
+	}
+}
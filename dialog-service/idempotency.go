@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Идемпотентная отправка: клиент передает ключ в client_message_id или в
+// заголовке Idempotency-Key (client_message_id приоритетнее). Повтор с тем же
+// ключом от того же отправителя в той же беседе в течение idempotencyWindow
+// не создает сообщение, а возвращает сохраненное при первой отправке. Ключ
+// хранится на шарде беседы вместе с сообщением; устаревшие ключи удаляются
+// раз в час.
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotencyReplayHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+var idempotencyWindow = envDuration("DIALOG_IDEMPOTENCY_WINDOW", 24*time.Hour)
+
+var errIdempotencyKeyTooLong = errors.New("idempotency key is too long")
+
+// sendIdempotencyKey возвращает ключ идемпотентности запроса на отправку ("" - без ключа)
+func sendIdempotencyKey(c *gin.Context, req *MessageSendRequest) (string, error) {
+	key := req.ClientMessageID
+	if key == "" {
+		key = c.GetHeader(idempotencyKeyHeader)
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return "", errIdempotencyKeyTooLong
+	}
+	return key, nil
+}
+
+func runIdempotencyPurge(ctx context.Context, store DialogStore) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := store.PurgeIdempotencyKeys(ctx, time.Now().Add(-idempotencyWindow))
+		if err != nil {
+			log.Printf("Idempotency keys purge failed: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired idempotency keys", purged)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"social-network-common/env"
+	"social-network-common/jwtkeys"
+)
+
+// Access tokens are issued by the monolith; dialog-service only verifies them,
+// so it needs the HMAC secrets or the RSA public keys, addressed by kid.
+//
+// Configuration:
+//
+//	JWT_HMAC_KEYS        kid:secret,kid:secret
+//	JWT_RSA_PUBLIC_KEYS  kid:/path/public.pem,...
+//	JWT_ISSUER           expected issuer (social-network-monolith)
+//	JWT_AUDIENCE         expected audience (social-network)
+//	JWT_INSECURE_DEV     1 to accept the published development key when no keys are set
+//	DIALOG_TOKEN_MAX_AGE oldest accepted token, by iat (5m)
+//
+// The sessions live in the monolith, so a token of a revoked session is not
+// recognised here: it keeps working until it is DIALOG_TOKEN_MAX_AGE old rather
+// than for its whole JWT_TTL. The monolith proxy checks the session itself and
+// forwards a token it has just issued; clients calling dialog-service directly
+// need one refreshed within that age.
+//
+// Without keys the service refuses to start.
+type jwtVerifier struct {
+	keys     map[string]any // kid -> []byte | *rsa.PublicKey
+	issuer   string
+	audience string
+	maxAge   time.Duration
+}
+
+var errTokenTooOld = errors.New("token is older than DIALOG_TOKEN_MAX_AGE")
+
+var jwtKeys *jwtVerifier // loaded in main
+
+func loadJWTVerifier() (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		keys:     make(map[string]any),
+		issuer:   env.OrDefault("JWT_ISSUER", "social-network-monolith"),
+		audience: env.OrDefault("JWT_AUDIENCE", "social-network"),
+		maxAge:   envDuration("DIALOG_TOKEN_MAX_AGE", 5*time.Minute),
+	}
+
+	for _, kv := range jwtkeys.SplitKeyList(os.Getenv("JWT_HMAC_KEYS")) {
+		v.keys[kv[0]] = []byte(kv[1])
+	}
+	if err := jwtkeys.LoadRSAPublicKeys(os.Getenv("JWT_RSA_PUBLIC_KEYS"), v.keys); err != nil {
+		return nil, err
+	}
+
+	if len(v.keys) == 0 {
+		kid, secret, err := jwtkeys.DevKey()
+		if err != nil {
+			return nil, err
+		}
+		v.keys[kid] = secret
+	}
+	return v, nil
+}
+
+// Verify checks signature, issuer, audience, expiry and age and returns the user ID (sub)
+func (v *jwtVerifier) Verify(tokenString string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, jwtkeys.KeyFunc(v.keys),
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithAudience(v.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", err
+	}
+	if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > v.maxAge {
+		return "", errTokenTooOld
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyRejectsOldTokens(t *testing.T) {
+	v := &jwtVerifier{
+		keys:     map[string]any{"k1": []byte("secret")},
+		issuer:   "social-network-monolith",
+		audience: "social-network",
+		maxAge:   5 * time.Minute,
+	}
+	sign := func(issuedAt time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+			Subject:   "user",
+			Issuer:    v.issuer,
+			Audience:  jwt.ClaimStrings{v.audience},
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(15 * time.Minute)),
+		})
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	if userId, err := v.Verify(sign(time.Now().Add(-time.Minute))); err != nil || userId != "user" {
+		t.Fatalf("fresh token: %q, %v", userId, err)
+	}
+	// not expired yet, but older than DIALOG_TOKEN_MAX_AGE
+	if _, err := v.Verify(sign(time.Now().Add(-10 * time.Minute))); !errors.Is(err, errTokenTooOld) {
+		t.Fatalf("old token: err = %v, want errTokenTooOld", err)
+	}
+}
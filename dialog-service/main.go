@@ -1,195 +1,574 @@
-package main
-
-import (
-	"log"
-	"net/http"
-	"os"
-	"sync"
-	"time"
-
-	"github.com/gin-gonic/gin"
-)
-
-// Models
-type DialogMessage struct {
-	From      string    `json:"from"`
-	To        string    `json:"to"`
-	Text      string    `json:"text"`
-	Timestamp time.Time `json:"timestamp"`
-}
-
-type MessageSendRequest struct {
-	Text string `json:"text" binding:"required"`
-}
-
-// Storage for dialog service
-type DialogStorage struct {
-	dialogs map[string][]*DialogMessage // sorted userIds key -> messages
-	mu      sync.RWMutex
-}
-
-var storage = &DialogStorage{
-	dialogs: make(map[string][]*DialogMessage),
-}
-
-// Helper functions
-func createDialogKey(userId1, userId2 string) string {
-	if userId1 < userId2 {
-		return userId1 + "_" + userId2
-	}
-	return userId2 + "_" + userId1
-}
-
-// Middleware для получения userId из заголовка
-func userContextMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		userId := c.GetHeader("X-User-ID")
-		if userId == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"message": "User ID header required"})
-			c.Abort()
-			return
-		}
-
-		c.Set("userId", userId)
-		c.Next()
-	}
-}
-
-// Dialog handlers
-func sendMessage(c *gin.Context) {
-	currentUserId := c.GetString("userId")
-	toUserId := c.Param("user_id")
-	
-	var req MessageSendRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request data"})
-		return
-	}
-
-	if currentUserId == toUserId {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot send message to yourself"})
-		return
-	}
-
-	message := &DialogMessage{
-		From:      currentUserId,
-		To:        toUserId,
-		Text:      req.Text,
-		Timestamp: time.Now(),
-	}
-
-	dialogKey := createDialogKey(currentUserId, toUserId)
-	
-	storage.mu.Lock()
-	storage.dialogs[dialogKey] = append(storage.dialogs[dialogKey], message)
-	storage.mu.Unlock()
-
-	log.Printf("Message sent from %s to %s: %s", currentUserId, toUserId, req.Text)
-	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully"})
-}
-
-func getDialog(c *gin.Context) {
-	currentUserId := c.GetString("userId")
-	otherUserId := c.Param("user_id")
-
-	dialogKey := createDialogKey(currentUserId, otherUserId)
-	
-	storage.mu.RLock()
-	messages := storage.dialogs[dialogKey]
-	storage.mu.RUnlock()
-
-	if messages == nil {
-		messages = []*DialogMessage{}
-	}
-
-	log.Printf("Retrieved %d messages for dialog between %s and %s", len(messages), currentUserId, otherUserId)
-	c.JSON(http.StatusOK, messages)
-}
-
-// Health check для мониторинга
-func healthCheck(c *gin.Context) {
-	storage.mu.RLock()
-	totalMessages := 0
-	totalDialogs := len(storage.dialogs)
-	for _, messages := range storage.dialogs {
-		totalMessages += len(messages)
-	}
-	storage.mu.RUnlock()
-
-	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-		"service": "dialog-service",
-		"stats": gin.H{
-			"total_dialogs": totalDialogs,
-			"total_messages": totalMessages,
-		},
-	})
-}
-
-// Получение всех диалогов пользователя
-func getUserDialogs(c *gin.Context) {
-	currentUserId := c.GetString("userId")
-	
-	storage.mu.RLock()
-	userDialogs := make(map[string][]*DialogMessage)
-	
-	for dialogKey, messages := range storage.dialogs {
-		// Проверяем, участвует ли текущий пользователь в диалоге
-		if len(messages) > 0 {
-			firstMessage := messages[0]
-			if firstMessage.From == currentUserId || firstMessage.To == currentUserId {
-				userDialogs[dialogKey] = messages
-			}
-		}
-	}
-	storage.mu.RUnlock()
-
-	c.JSON(http.StatusOK, userDialogs)
-}
-
-func setupRoutes() *gin.Engine {
-	r := gin.Default()
-
-	// CORS middleware
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-User-ID")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-
-		c.Next()
-	})
-
-	// Health check
-	r.GET("/health", healthCheck)
-
-	// Protected routes (требуют X-User-ID заголовок)
-	protected := r.Group("/")
-	protected.Use(userContextMiddleware())
-	{
-		// Dialog routes
-		protected.POST("/dialog/:user_id/send", sendMessage)
-		protected.GET("/dialog/:user_id/list", getDialog)
-		
-		protected.GET("/dialogs", getUserDialogs)
-	}
-
-	return r
-}
-
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8081"
-	}
-
-	r := setupRoutes()
-	
-	log.Printf("Dialog Service starting on port %s", port)
-	log.Fatal(r.Run(":" + port))
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"social-network-common/env"
+)
+
+// Models
+type DialogMessage struct {
+	ID             string     `json:"id"`
+	ConversationID string     `json:"conversation_id"`
+	From           string     `json:"from"`
+	Text           string     `json:"text"`
+	Timestamp      time.Time  `json:"timestamp"`
+	Edited         bool       `json:"edited"`
+	EditedAt       *time.Time `json:"edited_at,omitempty"`
+}
+
+type MessageSendRequest struct {
+	Text            string `json:"text" binding:"required"`
+	ClientMessageID string `json:"client_message_id"` // ключ идемпотентности, см. idempotency.go
+}
+
+type MessageEditRequest struct {
+	Text string `json:"text" binding:"required"`
+}
+
+type ReadCursorRequest struct {
+	MessageID string `json:"message_id" binding:"required"`
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// Storage for dialog service
+var storage DialogStore
+
+// deleteWindow - сколько после отправки сообщение можно удалить у обоих участников
+var deleteWindow = envDuration("DIALOG_DELETE_WINDOW", 48*time.Hour)
+
+// Helper functions
+func createDialogKey(userId1, userId2 string) string {
+	if userId1 < userId2 {
+		return userId1 + "_" + userId2
+	}
+	return userId2 + "_" + userId1
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, v, err)
+	}
+	return d
+}
+
+// peerFromDialogKey возвращает собеседника userId по ключу личного диалога ("" для группы)
+func peerFromDialogKey(dialogKey, userId string) string {
+	if isGroupKey(dialogKey) {
+		return ""
+	}
+	first, second, _ := strings.Cut(dialogKey, "_")
+	if first == userId {
+		return second
+	}
+	return first
+}
+
+// Middleware для получения userId из JWT (проверяется локально, без обращения к монолиту)
+func userContextMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Authorization header required"})
+			c.Abort()
+			return
+		}
+
+		tokenParts := strings.Split(authHeader, " ")
+		if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid authorization format"})
+			c.Abort()
+			return
+		}
+
+		userId, err := jwtKeys.Verify(tokenParts[1])
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userId", userId)
+		c.Next()
+	}
+}
+
+// Dialog handlers: беседу (личный диалог или группу) выбирает directConversation/groupConversation
+func sendMessage(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+	toUserId := c.Param("user_id")
+	dialogKey := c.GetString("dialogKey")
+	
+	var req MessageSendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request data"})
+		return
+	}
+
+	if currentUserId == toUserId {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot send message to yourself"})
+		return
+	}
+
+	idempotencyKey, err := sendIdempotencyKey(c, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Idempotency key is too long"})
+		return
+	}
+
+	message, replayed, err := sendToConversation(c.Request.Context(), dialogKey, currentUserId, req.Text, idempotencyKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotMember):
+			c.JSON(http.StatusForbidden, gin.H{"message": "You are not a member of this conversation"})
+		case errors.Is(err, errMessageNotFound):
+			c.JSON(http.StatusConflict, gin.H{"message": "Message sent with this idempotency key has been deleted"})
+		default:
+			log.Printf("Failed to store message: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store message"})
+		}
+		return
+	}
+
+	if replayed {
+		log.Printf("Replayed message %s from %s to %s (request %s)", message.ID, currentUserId, dialogKey, c.GetString("requestId"))
+		c.Header(idempotencyReplayHeader, "true")
+	} else {
+		log.Printf("Message sent from %s to %s: %s (request %s)", currentUserId, dialogKey, req.Text, c.GetString("requestId"))
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully", "id": message.ID, "timestamp": message.Timestamp})
+}
+
+// sendToConversation сохраняет сообщение (общая часть HTTP и gRPC); replayed - сообщение
+// уже было отправлено с этим ключом идемпотентности и возвращено из хранилища
+func sendToConversation(ctx context.Context, dialogKey, userId, text, idempotencyKey string) (*DialogMessage, bool, error) {
+	message := &DialogMessage{
+		ConversationID: dialogKey,
+		From:           userId,
+		Text:           text,
+		Timestamp:      time.Now(),
+	}
+	stored, err := storage.Append(ctx, dialogKey, message, idempotencyKey)
+	if err != nil {
+		return nil, false, err
+	}
+	// при повторе хранилище возвращает сообщение первой отправки
+	if stored != message {
+		return stored, true, nil
+	}
+	newMessages.publish(dialogKey)
+	return stored, false, nil
+}
+
+func getDialog(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+	dialogKey := c.GetString("dialogKey")
+
+	q, ok := parseListQuery(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid before, after or limit"})
+		return
+	}
+	
+	messages, err := readConversation(c.Request.Context(), dialogKey, currentUserId, q)
+	if err != nil {
+		log.Printf("Failed to load dialog %s: %v", dialogKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to load dialog"})
+		return
+	}
+
+	log.Printf("Retrieved %d messages of %s for %s", len(messages), dialogKey, currentUserId)
+	c.JSON(http.StatusOK, messages)
+}
+
+// readConversation отдает страницу истории userId (общая часть HTTP и gRPC). Получатель
+// прочитал страницу: курсор сдвигается на последнее сообщение, счетчик пересчитывается.
+func readConversation(ctx context.Context, dialogKey, userId string, q ListQuery) ([]*DialogMessage, error) {
+	q.Viewer = userId
+	messages, err := storage.List(ctx, dialogKey, q)
+	if err != nil {
+		return nil, err
+	}
+	if messages == nil {
+		messages = []*DialogMessage{}
+	}
+
+	if lastRead := lastIncoming(messages, userId); lastRead != "" {
+		if err := storage.SetReadCursor(ctx, dialogKey, userId, lastRead); err != nil {
+			log.Printf("Failed to advance read cursor for %s: %v", dialogKey, err)
+		}
+	}
+	return messages, nil
+}
+
+// lastIncoming возвращает ID последнего сообщения страницы от других участников
+func lastIncoming(messages []*DialogMessage, userId string) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].From != userId {
+			return messages[i].ID
+		}
+	}
+	return ""
+}
+
+// parseListQuery читает before/after (ID сообщений) и limit из query string
+func parseListQuery(c *gin.Context) (ListQuery, bool) {
+	limit := 0
+	if limitStr := c.Query("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n <= 0 {
+			return ListQuery{}, false
+		}
+		limit = n
+	}
+	return newListQuery(c.Query("before"), c.Query("after"), limit)
+}
+
+// newListQuery проверяет параметры страницы истории; limit 0 - размер по умолчанию
+func newListQuery(before, after string, limit int) (ListQuery, bool) {
+	q := ListQuery{Before: before, After: after, Limit: defaultPageLimit}
+	if q.Before != "" && q.After != "" {
+		return q, false
+	}
+	for _, id := range []string{q.Before, q.After} {
+		if id != "" && uuid.Validate(id) != nil {
+			return q, false
+		}
+	}
+	if limit < 0 {
+		return q, false
+	}
+	if limit > 0 {
+		q.Limit = min(limit, maxPageLimit)
+	}
+	return q, true
+}
+
+// Редактирование и удаление своих сообщений
+func editMessage(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+	dialogKey := c.GetString("dialogKey")
+	messageId := c.Param("message_id")
+
+	var req MessageEditRequest
+	if err := c.ShouldBindJSON(&req); err != nil || uuid.Validate(messageId) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request data"})
+		return
+	}
+
+	message, err := storage.Edit(c.Request.Context(), dialogKey, currentUserId, messageId, req.Text)
+	if err != nil {
+		respondMessageError(c, "edit", messageId, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, message)
+}
+
+// deleteMessage удаляет сообщение у обоих участников (for=everyone, только свое и в пределах
+// DIALOG_DELETE_WINDOW) или только у себя (for=me, по умолчанию)
+func deleteMessage(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+	dialogKey := c.GetString("dialogKey")
+	messageId := c.Param("message_id")
+
+	if uuid.Validate(messageId) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid message ID"})
+		return
+	}
+
+	var err error
+	switch c.DefaultQuery("for", "me") {
+	case "me":
+		err = storage.Hide(c.Request.Context(), dialogKey, currentUserId, messageId)
+	case "everyone":
+		err = storage.Delete(c.Request.Context(), dialogKey, currentUserId, messageId, deleteWindow)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Parameter for must be me or everyone"})
+		return
+	}
+	if err != nil {
+		respondMessageError(c, "delete", messageId, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message deleted"})
+}
+
+func respondMessageError(c *gin.Context, action, messageId string, err error) {
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Message not found"})
+	case errors.Is(err, errNotMessageAuthor):
+		c.JSON(http.StatusForbidden, gin.H{"message": "You can only change your own messages"})
+	case errors.Is(err, errDeleteWindowExpired):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Message is too old to delete for everyone"})
+	default:
+		log.Printf("Failed to %s message %s: %v", action, messageId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to " + action + " message"})
+	}
+}
+
+// Курсор прочтения: UI продолжает чтение диалога с последнего прочитанного сообщения
+func getReadCursor(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+	dialogKey := c.GetString("dialogKey")
+
+	messageId, err := storage.ReadCursor(c.Request.Context(), dialogKey, currentUserId)
+	if err != nil {
+		log.Printf("Failed to load read cursor for %s: %v", dialogKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to load read cursor"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"last_read_message_id": messageId})
+}
+
+func setReadCursor(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+	dialogKey := c.GetString("dialogKey")
+
+	var req ReadCursorRequest
+	if err := c.ShouldBindJSON(&req); err != nil || uuid.Validate(req.MessageID) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request data"})
+		return
+	}
+
+	err := storage.SetReadCursor(c.Request.Context(), dialogKey, currentUserId, req.MessageID)
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Message not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to store read cursor for %s: %v", dialogKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store read cursor"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Read cursor updated"})
+}
+
+// Непрочитанные сообщения пользователя: всего и по диалогам
+func getUnreadTotal(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+
+	dialogs, err := storage.Unread(c.Request.Context(), currentUserId)
+	if err != nil {
+		log.Printf("Failed to load unread counters of %s: %v", currentUserId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to load unread counters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": unreadTotal(dialogs)})
+}
+
+func getUnreadDialogs(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+
+	dialogs, err := storage.Unread(c.Request.Context(), currentUserId)
+	if err != nil {
+		log.Printf("Failed to load unread counters of %s: %v", currentUserId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to load unread counters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": unreadTotal(dialogs), "dialogs": dialogs})
+}
+
+func unreadTotal(dialogs []DialogUnread) int {
+	total := 0
+	for _, d := range dialogs {
+		total += d.Unread
+	}
+	return total
+}
+
+// Health check для мониторинга и балансировщика монолита, который опрашивает
+// его каждые несколько секунд, поэтому только пингует хранилище
+func healthCheck(c *gin.Context) {
+	if err := storage.Ping(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "error",
+			"service": "dialog-service",
+			"message": "Storage unavailable",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"service": "dialog-service",
+	})
+}
+
+// Размер хранилища; для PostgreSQL - оценка по статистике, см. postgresStore.Stats
+func getStats(c *gin.Context) {
+	stats, err := storage.Stats(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Storage unavailable"})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// Список диалогов пользователя, самые активные первыми; следующая страница - before=<last_message_id последнего>
+func getUserDialogs(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+	
+	limit := 0
+	if limitStr := c.Query("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid before or limit"})
+			return
+		}
+		limit = n
+	}
+	q, ok := newDialogsQuery(c.Query("before"), limit)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid before or limit"})
+		return
+	}
+
+	dialogs, err := storage.UserDialogs(c.Request.Context(), currentUserId, q)
+	if err != nil {
+		log.Printf("Failed to load dialogs of %s: %v", currentUserId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to load dialogs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, dialogs)
+}
+
+// newDialogsQuery проверяет параметры страницы списка диалогов; limit 0 - размер по умолчанию
+func newDialogsQuery(before string, limit int) (DialogsQuery, bool) {
+	q := DialogsQuery{Before: before, Limit: defaultPageLimit}
+	if (q.Before != "" && uuid.Validate(q.Before) != nil) || limit < 0 {
+		return q, false
+	}
+	if limit > 0 {
+		q.Limit = min(limit, maxPageLimit)
+	}
+	return q, true
+}
+
+func setupRoutes() *gin.Engine {
+	r := gin.Default()
+
+	// CORS middleware
+	r.Use(func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Request-ID, Idempotency-Key")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	})
+
+	// X-Request-ID: монолит передает свой, при прямом обращении генерируем
+	r.Use(func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" {
+			id = uuid.New().String()
+		}
+		c.Header("X-Request-ID", id)
+		c.Set("requestId", id)
+		c.Next()
+	})
+
+	// Health check
+	r.GET("/health", healthCheck)
+	r.GET("/stats", getStats)
+
+	// Protected routes (требуют Bearer JWT, выпущенный монолитом)
+	protected := r.Group("/")
+	protected.Use(userContextMiddleware())
+	{
+		// Dialog routes
+		direct := protected.Group("/dialog/:user_id", directConversation())
+		direct.POST("/send", sendMessage)
+		direct.GET("/list", getDialog)
+		direct.GET("/read", getReadCursor)
+		direct.PUT("/read", setReadCursor)
+		direct.PUT("/message/:message_id", editMessage)
+		direct.DELETE("/message/:message_id", deleteMessage)
+		protected.GET("/dialog/unread", getUnreadTotal)
+
+		// Group routes: те же операции с сообщениями плюс управление участниками
+		protected.POST("/groups", createGroup)
+		group := protected.Group("/group/:group_id", groupConversation())
+		group.GET("", getGroup)
+		group.POST("/send", sendMessage)
+		group.GET("/list", getDialog)
+		group.GET("/read", getReadCursor)
+		group.PUT("/read", setReadCursor)
+		group.PUT("/message/:message_id", editMessage)
+		group.DELETE("/message/:message_id", deleteMessage)
+		group.POST("/members", addGroupMember)
+		group.DELETE("/members/:member_id", removeGroupMember)
+		group.PUT("/members/:member_id/role", setGroupMemberRole)
+		
+		protected.GET("/dialogs", getUserDialogs)
+		protected.GET("/dialogs/unread", getUnreadDialogs)
+	}
+
+	return r
+}
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8081"
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "-reshard" {
+		if err := runReshard(context.Background()); err != nil {
+			log.Fatalf("Resharding failed: %v", err)
+		}
+		return
+	}
+
+	var err error
+	if jwtKeys, err = loadJWTVerifier(); err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+
+	storage, err = newDialogStore(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to initialize dialog storage: %v", err)
+	}
+	defer storage.Close()
+
+	go runReconciler(context.Background(), storage)
+	go runIdempotencyPurge(context.Background(), storage)
+	go serveGRPC(env.OrDefault("GRPC_PORT", "9081"))
+
+	r := setupRoutes()
+	
+	log.Printf("Dialog Service starting on port %s", port)
+	log.Fatal(r.Run(":" + port))
 }
\ No newline at end of file
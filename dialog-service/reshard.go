@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Решардинг (./main -reshard) переносит диалоги, чей владелец в DIALOG_RING
+// отличается от шарда, где они лежат. Порядок без простоя:
+//
+//  1. перезапустить все экземпляры с новым DIALOG_RING и DIALOG_RING_PREV=<старое кольцо>:
+//     запись идет в новый шард, чтение объединяет старый и новый;
+//  2. запустить -reshard с той же конфигурацией (можно повторять, перенос идемпотентен);
+//  3. убрать DIALOG_RING_PREV.
+//
+// Сообщения копируются пачками с ON CONFLICT DO NOTHING и удаляются из
+// источника только по ID скопированных, поэтому ни одно сообщение не теряется.
+// Весь перенос диалога идет в одной транзакции источника под исключительной
+// блокировкой диалога (lockDialog): правки, удаления и скрытия на старом шарде
+// ждут ее конца, а не теряются между копированием и удалением.
+// Группы с участниками и отметки "удалено у себя" копируются до сообщений, чтобы
+// новый шард сразу знал состав группы, а скрытое сообщение ни на мгновение не
+// появилось у участника. Счетчики непрочитанных не копируются,
+// а строятся на новом шарде заново.
+const reshardBatchSize = 1000
+
+func runReshard(ctx context.Context) error {
+	s, err := newShardedStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	log.Printf("Resharding to ring %v", s.ring.names)
+
+	movedTotal := 0
+	for name, shard := range s.shards {
+		moved, err := s.drainShard(ctx, name, shard)
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", name, err)
+		}
+		movedTotal += moved
+	}
+	log.Printf("Resharding finished: %d dialogs moved", movedTotal)
+	return nil
+}
+
+// drainShard переносит с шарда все диалоги, которые ему больше не принадлежат
+func (s *shardedStore) drainShard(ctx context.Context, name string, shard *postgresStore) (int, error) {
+	moved := 0
+	after := ""
+	for {
+		rows, err := shard.db.Query(ctx,
+			`SELECT dialog_key FROM dialog_messages WHERE dialog_key > $1
+			 UNION
+			 SELECT dialog_key FROM dialog_read_cursors WHERE dialog_key > $1
+			 UNION
+			 SELECT dialog_key FROM user_dialogs WHERE dialog_key > $1
+			 UNION
+			 SELECT dialog_key FROM dialog_hidden_messages WHERE dialog_key > $1
+			 UNION
+			 SELECT dialog_key FROM conversation_members WHERE dialog_key > $1
+			 ORDER BY dialog_key LIMIT $2`,
+			after, reshardBatchSize)
+		if err != nil {
+			return moved, err
+		}
+		keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return moved, err
+		}
+
+		for _, dialogKey := range keys {
+			owner := s.ring.Owner(dialogKey)
+			if owner == name {
+				continue
+			}
+			n, err := moveDialog(ctx, dialogKey, shard, s.shards[owner])
+			if err != nil {
+				return moved, fmt.Errorf("move dialog %s to %s: %w", dialogKey, owner, err)
+			}
+			log.Printf("Moved dialog %s: %s -> %s (%d messages)", dialogKey, name, owner, n)
+			moved++
+		}
+
+		if len(keys) < reshardBatchSize {
+			return moved, nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// moveDialog копирует сообщения диалога пачками и удаляет из источника только скопированные,
+// затем переносит курсоры прочтения и счетчики непрочитанных. Источник читается и
+// чистится в одной транзакции, которая держит блокировку диалога до конца переноса.
+func moveDialog(ctx context.Context, dialogKey string, srcStore, dst *postgresStore) (int, error) {
+	src, err := srcStore.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Rollback(ctx)
+	if err := lockDialog(ctx, src, dialogKey, true); err != nil {
+		return 0, err
+	}
+
+	moved, err := moveDialogLocked(ctx, dialogKey, src, dst)
+	if err != nil {
+		return moved, err
+	}
+	return moved, src.Commit(ctx)
+}
+
+func moveDialogLocked(ctx context.Context, dialogKey string, src pgx.Tx, dst *postgresStore) (int, error) {
+	if err := copyConversation(ctx, dialogKey, src, dst); err != nil {
+		return 0, err
+	}
+	if err := copyHiddenMessages(ctx, dialogKey, src, dst); err != nil {
+		return 0, err
+	}
+	if err := copyIdempotencyKeys(ctx, dialogKey, src, dst); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for {
+		rows, err := src.Query(ctx,
+			`SELECT `+messageColumns+` FROM dialog_messages
+			 WHERE dialog_key = $1 ORDER BY id LIMIT $2`,
+			dialogKey, reshardBatchSize)
+		if err != nil {
+			return moved, err
+		}
+		messages, err := scanMessages(rows)
+		if err != nil {
+			return moved, err
+		}
+		if len(messages) == 0 {
+			if err := moveReadCursors(ctx, dialogKey, src, dst); err != nil {
+				return moved, err
+			}
+			for _, table := range []string{"dialog_hidden_messages", "dialog_idempotency_keys", "conversation_members", "conversations"} {
+				if _, err := src.Exec(ctx, "DELETE FROM "+table+" WHERE dialog_key = $1", dialogKey); err != nil {
+					return moved, err
+				}
+			}
+			return moved, moveUnreadCounters(ctx, dialogKey, src, dst)
+		}
+
+		batch := &pgx.Batch{}
+		ids := make([]string, len(messages))
+		for i, m := range messages {
+			ids[i] = m.ID
+			batch.Queue(
+				`INSERT INTO dialog_messages (id, dialog_key, from_user, text, created_at, edited_at)
+				 VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`,
+				m.ID, dialogKey, m.From, m.Text, m.Timestamp, m.EditedAt)
+		}
+		if err := dst.db.SendBatch(ctx, batch).Close(); err != nil {
+			return moved, err
+		}
+
+		if _, err := src.Exec(ctx,
+			"DELETE FROM dialog_messages WHERE dialog_key = $1 AND id = ANY($2::text[]::uuid[])",
+			dialogKey, ids); err != nil {
+			return moved, err
+		}
+		moved += len(messages)
+	}
+}
+
+// moveReadCursors переносит курсоры; курсор на новом шарде мог уже уйти вперед, поэтому берется больший
+func moveReadCursors(ctx context.Context, dialogKey string, src pgx.Tx, dst *postgresStore) error {
+	rows, err := src.Query(ctx,
+		"SELECT user_id, last_read_id::text FROM dialog_read_cursors WHERE dialog_key = $1", dialogKey)
+	if err != nil {
+		return err
+	}
+	type cursor struct{ userId, messageId string }
+	cursors, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (cursor, error) {
+		var c cursor
+		err := row.Scan(&c.userId, &c.messageId)
+		return c, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range cursors {
+		if err := dst.setReadCursor(ctx, dialogKey, c.userId, c.messageId, false); err != nil {
+			return err
+		}
+	}
+	_, err = src.Exec(ctx, "DELETE FROM dialog_read_cursors WHERE dialog_key = $1", dialogKey)
+	return err
+}
+
+// moveUnreadCounters пересчитывает счетчики на новом шарде, где уже лежат все сообщения и курсоры
+func moveUnreadCounters(ctx context.Context, dialogKey string, src pgx.Tx, dst *postgresStore) error {
+	tx, err := dst.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := recountDialog(ctx, tx, dialogKey); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	_, err = src.Exec(ctx, "DELETE FROM user_dialogs WHERE dialog_key = $1", dialogKey)
+	return err
+}
+
+// copyHiddenMessages копирует отметки "удалено у себя"; из источника они удаляются вместе с последними сообщениями
+func copyHiddenMessages(ctx context.Context, dialogKey string, src pgx.Tx, dst *postgresStore) error {
+	rows, err := src.Query(ctx,
+		"SELECT user_id, message_id::text FROM dialog_hidden_messages WHERE dialog_key = $1", dialogKey)
+	if err != nil {
+		return err
+	}
+	type hidden struct{ userId, messageId string }
+	marks, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (hidden, error) {
+		var h hidden
+		err := row.Scan(&h.userId, &h.messageId)
+		return h, err
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	for _, h := range marks {
+		batch.Queue(
+			`INSERT INTO dialog_hidden_messages (dialog_key, user_id, message_id) VALUES ($1, $2, $3::uuid)
+			 ON CONFLICT DO NOTHING`,
+			dialogKey, h.userId, h.messageId)
+	}
+	return dst.db.SendBatch(ctx, batch).Close()
+}
+
+// copyIdempotencyKeys копирует ключи идемпотентности, чтобы повтор отправки после переноса не задвоил сообщение
+func copyIdempotencyKeys(ctx context.Context, dialogKey string, src pgx.Tx, dst *postgresStore) error {
+	rows, err := src.Query(ctx,
+		`SELECT user_id, idempotency_key, message_id::text, created_at FROM dialog_idempotency_keys
+		 WHERE dialog_key = $1 AND created_at >= $2`,
+		dialogKey, time.Now().Add(-idempotencyWindow))
+	if err != nil {
+		return err
+	}
+	type sent struct {
+		userId, key, messageId string
+		createdAt              time.Time
+	}
+	keys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (sent, error) {
+		var k sent
+		err := row.Scan(&k.userId, &k.key, &k.messageId, &k.createdAt)
+		return k, err
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	for _, k := range keys {
+		batch.Queue(
+			`INSERT INTO dialog_idempotency_keys (dialog_key, user_id, idempotency_key, message_id, created_at)
+			 VALUES ($1, $2, $3, $4::uuid, $5) ON CONFLICT DO NOTHING`,
+			dialogKey, k.userId, k.key, k.messageId, k.createdAt)
+	}
+	return dst.db.SendBatch(ctx, batch).Close()
+}
+
+// copyConversation копирует группу и участников (у личного диалога - только участников);
+// из источника они удаляются вместе с последними сообщениями
+func copyConversation(ctx context.Context, dialogKey string, src pgx.Tx, dst *postgresStore) error {
+	batch := &pgx.Batch{}
+	var group Group
+	err := src.QueryRow(ctx,
+		"SELECT title, created_by, created_at FROM conversations WHERE dialog_key = $1",
+		dialogKey).Scan(&group.Title, &group.CreatedBy, &group.CreatedAt)
+	switch {
+	case err == nil:
+		batch.Queue(
+			`INSERT INTO conversations (dialog_key, title, created_by, created_at) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT DO NOTHING`,
+			dialogKey, group.Title, group.CreatedBy, group.CreatedAt)
+	case !errors.Is(err, pgx.ErrNoRows):
+		return err
+	}
+
+	rows, err := src.Query(ctx,
+		"SELECT user_id, role, joined_at FROM conversation_members WHERE dialog_key = $1", dialogKey)
+	if err != nil {
+		return err
+	}
+	type member struct {
+		userId, role string
+		joinedAt     time.Time
+	}
+	members, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (member, error) {
+		var m member
+		err := row.Scan(&m.userId, &m.role, &m.joinedAt)
+		return m, err
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		batch.Queue(
+			`INSERT INTO conversation_members (dialog_key, user_id, role, joined_at) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT DO NOTHING`,
+			dialogKey, m.userId, m.role, m.joinedAt)
+	}
+	return dst.db.SendBatch(ctx, batch).Close()
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Шардирование диалогов: ключ createDialogKey хэшируется на кольцо консистентного
+// хэширования, поэтому оба участника диалога всегда попадают на один шард,
+// а при добавлении шарда переезжает только ~1/N диалогов.
+//
+// Конфигурация:
+//
+//	DIALOG_SHARDS      name=url,name=url - все доступные шарды
+//	DIALOG_RING        имена шардов текущего кольца (по умолчанию все из DIALOG_SHARDS)
+//	DIALOG_RING_PREV   имена шардов предыдущего кольца, задается на время решардинга
+//	DIALOG_RING_VNODES виртуальных узлов на шард (128)
+//
+// Пока задан DIALOG_RING_PREV, запись идет в шард нового кольца, а чтение
+// объединяет новый и старый шард диалога, так что решардинг (-reshard) проходит
+// без остановки сервиса и без потери сообщений.
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]string
+	names  []string
+}
+
+func newHashRing(names []string, vnodes int) *hashRing {
+	r := &hashRing{owners: make(map[uint32]string), names: names}
+	for _, name := range names {
+		for i := 0; i < vnodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i)))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = name
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner возвращает шард, которому принадлежит ключ: первый виртуальный узел по часовой стрелке
+func (r *hashRing) Owner(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+type shardedStore struct {
+	shards map[string]*postgresStore
+	ring   *hashRing
+	prev   *hashRing // nil вне решардинга
+}
+
+func newShardedStore(ctx context.Context) (*shardedStore, error) {
+	shardURLs, err := parseShardList(os.Getenv("DIALOG_SHARDS"))
+	if err != nil {
+		return nil, err
+	}
+
+	vnodes := 128
+	if v := os.Getenv("DIALOG_RING_VNODES"); v != "" {
+		if vnodes, err = strconv.Atoi(v); err != nil || vnodes <= 0 {
+			return nil, fmt.Errorf("invalid DIALOG_RING_VNODES %q", v)
+		}
+	}
+
+	s := &shardedStore{shards: make(map[string]*postgresStore)}
+	for name, url := range shardURLs {
+		shard, err := newPostgresStore(ctx, url)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("shard %s: %w", name, err)
+		}
+		s.shards[name] = shard
+	}
+
+	ringNames, err := s.ringNames(os.Getenv("DIALOG_RING"))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.ring = newHashRing(ringNames, vnodes)
+
+	if prev := os.Getenv("DIALOG_RING_PREV"); prev != "" {
+		prevNames, err := s.ringNames(prev)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.prev = newHashRing(prevNames, vnodes)
+		log.Printf("Resharding mode: ring %v, previous ring %v", ringNames, prevNames)
+	} else {
+		log.Printf("Dialog shards: %v", ringNames)
+	}
+	return s, nil
+}
+
+// parseShardList разбирает "name=url,name=url"
+func parseShardList(s string) (map[string]string, error) {
+	shards := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, url, ok := strings.Cut(item, "=")
+		if !ok || name == "" || url == "" {
+			return nil, fmt.Errorf("malformed DIALOG_SHARDS entry %q", item)
+		}
+		shards[name] = url
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("DIALOG_SHARDS is empty")
+	}
+	return shards, nil
+}
+
+// ringNames проверяет список имен шардов кольца; пустой список - все шарды
+func (s *shardedStore) ringNames(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := s.shards[name]; !ok {
+			return nil, fmt.Errorf("ring references unknown shard %q", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		for name := range s.shards {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *shardedStore) shardFor(dialogKey string) *postgresStore {
+	return s.shards[s.ring.Owner(dialogKey)]
+}
+
+// prevShardFor возвращает старый шард диалога, если он отличается от нового
+func (s *shardedStore) prevShardFor(dialogKey string) *postgresStore {
+	if s.prev == nil {
+		return nil
+	}
+	prevName := s.prev.Owner(dialogKey)
+	if prevName == s.ring.Owner(dialogKey) {
+		return nil
+	}
+	return s.shards[prevName]
+}
+
+// onShards выполняет op на шарде диалога, а во время решардинга, если там нет
+// нужных данных (ошибка notFound), - на старом шарде. Если нет и там, op
+// повторяется на новом: диалог мог переехать, пока op ждала его блокировку на
+// старом шарде (см. moveDialog).
+func onShards[T any](s *shardedStore, dialogKey string, notFound error, op func(*postgresStore) (T, error)) (T, error) {
+	result, err := op(s.shardFor(dialogKey))
+	prev := s.prevShardFor(dialogKey)
+	if prev == nil || !errors.Is(err, notFound) {
+		return result, err
+	}
+	if result, err = op(prev); !errors.Is(err, notFound) {
+		return result, err
+	}
+	return op(s.shardFor(dialogKey))
+}
+
+func (s *shardedStore) Append(ctx context.Context, dialogKey string, msg *DialogMessage, idempotencyKey string) (*DialogMessage, error) {
+	// Группа, которую еще не перенесли: сообщение пишется к ней, решардинг заберет его вместе с группой.
+	// Повтор личного сообщения, первая отправка которого еще на старом шарде, не распознается
+	// до переноса диалога.
+	return onShards(s, dialogKey, errConversationNotFound, func(shard *postgresStore) (*DialogMessage, error) {
+		return shard.Append(ctx, dialogKey, msg, idempotencyKey)
+	})
+}
+
+func (s *shardedStore) List(ctx context.Context, dialogKey string, q ListQuery) ([]*DialogMessage, error) {
+	messages, err := s.shardFor(dialogKey).List(ctx, dialogKey, q)
+	if err != nil {
+		return nil, err
+	}
+	if prev := s.prevShardFor(dialogKey); prev != nil {
+		old, err := prev.List(ctx, dialogKey, q)
+		if err != nil {
+			return nil, err
+		}
+		messages = q.page(mergeMessages(messages, old))
+	}
+	return messages, nil
+}
+
+func (s *shardedStore) ReadCursor(ctx context.Context, dialogKey, userId string) (string, error) {
+	cursor, err := s.shardFor(dialogKey).ReadCursor(ctx, dialogKey, userId)
+	if err != nil {
+		return "", err
+	}
+	if prev := s.prevShardFor(dialogKey); prev != nil {
+		old, err := prev.ReadCursor(ctx, dialogKey, userId)
+		if err != nil {
+			return "", err
+		}
+		if old > cursor {
+			cursor = old
+		}
+	}
+	return cursor, nil
+}
+
+func (s *shardedStore) SetReadCursor(ctx context.Context, dialogKey, userId, messageId string) error {
+	prev := s.prevShardFor(dialogKey)
+	if prev == nil {
+		return s.shardFor(dialogKey).SetReadCursor(ctx, dialogKey, userId, messageId)
+	}
+
+	// Во время решардинга сообщение может лежать на любом из шардов, а часть непрочитанных
+	// еще на старом: курсор проверяется на обоих и пересчитывается на обоих
+	if _, err := onShards(s, dialogKey, errMessageNotFound, func(shard *postgresStore) (struct{}, error) {
+		return struct{}{}, shard.MessageExists(ctx, dialogKey, messageId)
+	}); err != nil {
+		return err
+	}
+	if err := s.shardFor(dialogKey).setReadCursor(ctx, dialogKey, userId, messageId, false); err != nil {
+		return err
+	}
+	return prev.setReadCursor(ctx, dialogKey, userId, messageId, false)
+}
+
+// Edit, Delete и Hide ищут сообщение сначала на новом шарде, во время решардинга - и на старом
+
+func (s *shardedStore) Edit(ctx context.Context, dialogKey, userId, messageId, text string) (*DialogMessage, error) {
+	return onShards(s, dialogKey, errMessageNotFound, func(shard *postgresStore) (*DialogMessage, error) {
+		return shard.Edit(ctx, dialogKey, userId, messageId, text)
+	})
+}
+
+func (s *shardedStore) Delete(ctx context.Context, dialogKey, userId, messageId string, window time.Duration) error {
+	_, err := onShards(s, dialogKey, errMessageNotFound, func(shard *postgresStore) (struct{}, error) {
+		return struct{}{}, shard.Delete(ctx, dialogKey, userId, messageId, window)
+	})
+	return err
+}
+
+func (s *shardedStore) Hide(ctx context.Context, dialogKey, userId, messageId string) error {
+	_, err := onShards(s, dialogKey, errMessageNotFound, func(shard *postgresStore) (struct{}, error) {
+		return struct{}{}, shard.Hide(ctx, dialogKey, userId, messageId)
+	})
+	return err
+}
+
+// Группы: во время решардинга группа может быть еще на старом шарде
+
+func (s *shardedStore) CreateGroup(ctx context.Context, group *Group) error {
+	return s.shardFor(group.ID).CreateGroup(ctx, group)
+}
+
+func (s *shardedStore) Group(ctx context.Context, groupId string) (*Group, error) {
+	group, err := s.shardFor(groupId).Group(ctx, groupId)
+	if prev := s.prevShardFor(groupId); prev != nil && errors.Is(err, errConversationNotFound) {
+		return prev.Group(ctx, groupId)
+	}
+	return group, err
+}
+
+func (s *shardedStore) AddMember(ctx context.Context, groupId, actorId string, member GroupMember) error {
+	_, err := onShards(s, groupId, errConversationNotFound, func(shard *postgresStore) (struct{}, error) {
+		return struct{}{}, shard.AddMember(ctx, groupId, actorId, member)
+	})
+	return err
+}
+
+func (s *shardedStore) RemoveMember(ctx context.Context, groupId, actorId, userId string) error {
+	_, err := onShards(s, groupId, errConversationNotFound, func(shard *postgresStore) (struct{}, error) {
+		return struct{}{}, shard.RemoveMember(ctx, groupId, actorId, userId)
+	})
+	return err
+}
+
+func (s *shardedStore) SetMemberRole(ctx context.Context, groupId, actorId, userId, role string) error {
+	_, err := onShards(s, groupId, errConversationNotFound, func(shard *postgresStore) (struct{}, error) {
+		return struct{}{}, shard.SetMemberRole(ctx, groupId, actorId, userId, role)
+	})
+	return err
+}
+
+// Unread складывает счетчики со всех шардов: во время решардинга диалог может лежать на двух
+func (s *shardedStore) Unread(ctx context.Context, userId string) ([]DialogUnread, error) {
+	result := []DialogUnread{}
+	index := make(map[string]int)
+	for name, shard := range s.shards {
+		dialogs, err := shard.Unread(ctx, userId)
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %w", name, err)
+		}
+		for _, d := range dialogs {
+			if i, ok := index[d.DialogKey]; ok {
+				result[i].Unread += d.Unread
+				continue
+			}
+			index[d.DialogKey] = len(result)
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func (s *shardedStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	for name, shard := range s.shards {
+		n, err := shard.PurgeIdempotencyKeys(ctx, before)
+		if err != nil {
+			return purged, fmt.Errorf("shard %s: %w", name, err)
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+func (s *shardedStore) Reconcile(ctx context.Context) (int, error) {
+	fixed := 0
+	for name, shard := range s.shards {
+		n, err := shard.Reconcile(ctx)
+		if err != nil {
+			return fixed, fmt.Errorf("shard %s: %w", name, err)
+		}
+		fixed += n
+	}
+	return fixed, nil
+}
+
+// UserDialogs берет страницу с каждого шарда и выбирает из них общую страницу.
+// Во время решардинга диалог может быть на двух шардах: берется более новое
+// последнее сообщение, счетчики складываются.
+func (s *shardedStore) UserDialogs(ctx context.Context, userId string, q DialogsQuery) ([]*DialogSummary, error) {
+	byKey := make(map[string]*DialogSummary)
+	for name, shard := range s.shards {
+		dialogs, err := shard.UserDialogs(ctx, userId, q)
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %w", name, err)
+		}
+		for _, d := range dialogs {
+			seen, ok := byKey[d.DialogKey]
+			if !ok {
+				byKey[d.DialogKey] = d
+				continue
+			}
+			if d.LastMessageID > seen.LastMessageID {
+				d.Unread += seen.Unread
+				byKey[d.DialogKey] = d
+			} else {
+				seen.Unread += d.Unread
+			}
+		}
+	}
+
+	summaries := make([]*DialogSummary, 0, len(byKey))
+	for _, d := range byKey {
+		summaries = append(summaries, d)
+	}
+	return q.page(summaries), nil
+}
+
+func (s *shardedStore) Ping(ctx context.Context) error {
+	for name, shard := range s.shards {
+		if err := shard.Ping(ctx); err != nil {
+			return fmt.Errorf("shard %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) Stats(ctx context.Context) (DialogStats, error) {
+	var total DialogStats
+	for name, shard := range s.shards {
+		stats, err := shard.Stats(ctx)
+		if err != nil {
+			return total, fmt.Errorf("shard %s: %w", name, err)
+		}
+		total.TotalDialogs += stats.TotalDialogs
+		total.TotalMessages += stats.TotalMessages
+	}
+	return total, nil
+}
+
+func (s *shardedStore) Close() {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+}
+
+// mergeMessages объединяет сообщения одного диалога с двух шардов без дублей, по порядку ID
+func mergeMessages(a, b []*DialogMessage) []*DialogMessage {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	seen := make(map[string]bool, len(a)+len(b))
+	merged := make([]*DialogMessage, 0, len(a)+len(b))
+	for _, batch := range [][]*DialogMessage{a, b} {
+		for _, m := range batch {
+			if !seen[m.ID] {
+				seen[m.ID] = true
+				merged = append(merged, m)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].ID < merged[j].ID })
+	return merged
+}
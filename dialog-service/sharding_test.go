@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = createDialogKey(fmt.Sprintf("user-%d", i), fmt.Sprintf("user-%d", i+1))
+	}
+	return keys
+}
+
+func TestHashRingOwnerIsStable(t *testing.T) {
+	a := newHashRing([]string{"s1", "s2", "s3"}, 128)
+	b := newHashRing([]string{"s1", "s2", "s3"}, 128)
+	for _, key := range testKeys(1000) {
+		if a.Owner(key) != a.Owner(key) || a.Owner(key) != b.Owner(key) {
+			t.Fatalf("owner of %q is not stable", key)
+		}
+	}
+}
+
+func TestHashRingAddShardMovesKeysToItOnly(t *testing.T) {
+	old := newHashRing([]string{"s1", "s2", "s3"}, 128)
+	grown := newHashRing([]string{"s1", "s2", "s3", "s4"}, 128)
+
+	keys := testKeys(10000)
+	moved := 0
+	for _, key := range keys {
+		before, after := old.Owner(key), grown.Owner(key)
+		if before == after {
+			continue
+		}
+		if after != "s4" {
+			t.Fatalf("%q moved from %s to %s, not to the new shard", key, before, after)
+		}
+		moved++
+	}
+	// ожидается около четверти ключей
+	if share := float64(moved) / float64(len(keys)); share < 0.15 || share > 0.35 {
+		t.Fatalf("%.2f of the keys moved, want about 0.25", share)
+	}
+}
+
+func testShardedStore(ring, prev []string) *shardedStore {
+	s := &shardedStore{shards: make(map[string]*postgresStore)}
+	for _, name := range append(append([]string{}, ring...), prev...) {
+		if s.shards[name] == nil {
+			s.shards[name] = &postgresStore{}
+		}
+	}
+	s.ring = newHashRing(ring, 128)
+	if prev != nil {
+		s.prev = newHashRing(prev, 128)
+	}
+	return s
+}
+
+// movedKey возвращает ключ, у которого старый и новый шард различаются
+func movedKey(t *testing.T, s *shardedStore) string {
+	for _, key := range testKeys(1000) {
+		if s.prevShardFor(key) != nil {
+			return key
+		}
+	}
+	t.Fatal("no key changes its shard")
+	return ""
+}
+
+func TestPrevShardFor(t *testing.T) {
+	s := testShardedStore([]string{"s1", "s2"}, nil)
+	for _, key := range testKeys(100) {
+		if s.prevShardFor(key) != nil {
+			t.Fatalf("prevShardFor(%q) is set outside resharding", key)
+		}
+	}
+
+	s = testShardedStore([]string{"s1", "s2", "s3"}, []string{"s1", "s2"})
+	for _, key := range testKeys(1000) {
+		prev := s.prevShardFor(key)
+		switch {
+		case s.prev.Owner(key) == s.ring.Owner(key) && prev != nil:
+			t.Fatalf("prevShardFor(%q) is set though the owner did not change", key)
+		case s.prev.Owner(key) != s.ring.Owner(key) && prev != s.shards[s.prev.Owner(key)]:
+			t.Fatalf("prevShardFor(%q) is not the previous owner", key)
+		}
+	}
+}
+
+func TestOnShardsFallsBackToPrevAndRetriesNew(t *testing.T) {
+	s := testShardedStore([]string{"s1", "s2", "s3"}, []string{"s1", "s2"})
+	key := movedKey(t, s)
+	current, prev := s.shardFor(key), s.prevShardFor(key)
+
+	tests := []struct {
+		name    string
+		results []error // ответы шардов по очереди
+		calls   []*postgresStore
+		wantErr error
+	}{
+		{"found on the new shard", []error{nil}, []*postgresStore{current}, nil},
+		{"found on the old shard", []error{errMessageNotFound, nil}, []*postgresStore{current, prev}, nil},
+		{"moved while waiting", []error{errMessageNotFound, errMessageNotFound, nil}, []*postgresStore{current, prev, current}, nil},
+		{"missing everywhere", []error{errMessageNotFound, errMessageNotFound, errMessageNotFound}, []*postgresStore{current, prev, current}, errMessageNotFound},
+		{"other error", []error{errNotMessageAuthor}, []*postgresStore{current}, errNotMessageAuthor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []*postgresStore
+			_, err := onShards(s, key, errMessageNotFound, func(shard *postgresStore) (struct{}, error) {
+				calls = append(calls, shard)
+				return struct{}{}, tt.results[len(calls)-1]
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if len(calls) != len(tt.calls) {
+				t.Fatalf("%d calls, want %d", len(calls), len(tt.calls))
+			}
+			for i := range calls {
+				if calls[i] != tt.calls[i] {
+					t.Fatalf("call %d went to the wrong shard", i)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeMessages(t *testing.T) {
+	msg := func(id string) *DialogMessage { return &DialogMessage{ID: id} }
+	merged := mergeMessages(
+		[]*DialogMessage{msg("1"), msg("3"), msg("5")},
+		[]*DialogMessage{msg("2"), msg("3"), msg("4")},
+	)
+	var ids []string
+	for _, m := range merged {
+		ids = append(ids, m.ID)
+	}
+	if got, want := fmt.Sprint(ids), "[1 2 3 4 5]"; got != want {
+		t.Fatalf("merged ids = %s, want %s", got, want)
+	}
+}
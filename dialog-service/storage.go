@@ -0,0 +1,630 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DialogStore хранит беседы: личный диалог (ключ createDialogKey, два участника)
+// или группу (ключ - ID группы). Параметр dialogKey везде - ключ беседы.
+type DialogStore interface {
+	// Append сохраняет сообщение и атомарно с ним увеличивает счетчики непрочитанных
+	// остальных участников. ID сообщения выдает хранилище (nextMessageID) под
+	// блокировкой беседы, поэтому ID растут в порядке сохранения и годятся как
+	// курсор доставки (?after=, gRPC Stream). В группу могут
+	// писать только ее участники (errNotMember). Возвращает сохраненное сообщение:
+	// msg или, если idempotencyKey уже встречался у отправителя в этой беседе за
+	// idempotencyWindow, отправленное тогда (errMessageNotFound, если его удалили).
+	Append(ctx context.Context, dialogKey string, msg *DialogMessage, idempotencyKey string) (*DialogMessage, error)
+	// List возвращает страницу сообщений диалога в порядке отправки
+	List(ctx context.Context, dialogKey string, q ListQuery) ([]*DialogMessage, error)
+	// Edit меняет текст сообщения, отправленного userId
+	Edit(ctx context.Context, dialogKey, userId, messageId, text string) (*DialogMessage, error)
+	// Delete удаляет сообщение userId у обоих участников, если оно отправлено не раньше window назад
+	Delete(ctx context.Context, dialogKey, userId, messageId string, window time.Duration) error
+	// Hide скрывает сообщение только у userId
+	Hide(ctx context.Context, dialogKey, userId, messageId string) error
+	// ReadCursor возвращает ID последнего прочитанного участником сообщения ("" - ничего не прочитано)
+	ReadCursor(ctx context.Context, dialogKey, userId string) (string, error)
+	// SetReadCursor сдвигает курсор прочтения вперед (более старый ID игнорируется)
+	// и пересчитывает счетчик непрочитанных участника; errMessageNotFound - в диалоге нет такого сообщения
+	SetReadCursor(ctx context.Context, dialogKey, userId, messageId string) error
+	// Unread возвращает диалоги пользователя с непрочитанными сообщениями
+	Unread(ctx context.Context, userId string) ([]DialogUnread, error)
+	// Reconcile пересчитывает счетчики по сообщениям и курсорам, возвращает число исправленных
+	Reconcile(ctx context.Context) (int, error)
+	// UserDialogs возвращает страницу диалогов пользователя, самые активные первыми
+	UserDialogs(ctx context.Context, userId string, q DialogsQuery) ([]*DialogSummary, error)
+	// CreateGroup создает группу вместе с участниками
+	CreateGroup(ctx context.Context, group *Group) error
+	// Group возвращает группу с участниками (errConversationNotFound, если ее нет)
+	Group(ctx context.Context, groupId string) (*Group, error)
+	// AddMember добавляет участника от имени администратора actorId; история до вступления
+	// считается прочитанной
+	AddMember(ctx context.Context, groupId, actorId string, member GroupMember) error
+	// RemoveMember удаляет участника от имени администратора actorId или самого участника
+	RemoveMember(ctx context.Context, groupId, actorId, userId string) error
+	// SetMemberRole меняет роль участника от имени администратора actorId
+	SetMemberRole(ctx context.Context, groupId, actorId, userId, role string) error
+	// PurgeIdempotencyKeys удаляет ключи идемпотентности, выданные раньше before
+	PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error)
+	// Ping проверяет доступность хранилища; должна быть дешевой, ее дергает /health
+	Ping(ctx context.Context) error
+	// Stats возвращает размер хранилища (для PostgreSQL - оценку по статистике планировщика)
+	Stats(ctx context.Context) (DialogStats, error)
+	Close()
+}
+
+var (
+	errMessageNotFound     = errors.New("message not found")
+	errNotMessageAuthor    = errors.New("message sent by another user")
+	errDeleteWindowExpired = errors.New("delete window expired")
+
+	errConversationNotFound = errors.New("conversation not found")
+	errNotMember            = errors.New("user is not a member of the conversation")
+	errAlreadyMember        = errors.New("user is already a member of the conversation")
+	errGroupFull            = errors.New("group is full")
+	errNotGroupAdmin        = errors.New("user is not an admin of the group")
+	errLastAdmin            = errors.New("group must keep at least one admin")
+)
+
+// nextMessageID выдает UUIDv7 больше last - ID последнего сообщения беседы.
+// UUIDv7 двух сообщений одной миллисекунды или после перевода часов назад
+// может оказаться меньше, тогда берется last+1. Вызывается под блокировкой беседы.
+func nextMessageID(last string) (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	if last == "" || id.String() > last {
+		return id.String(), nil
+	}
+	prev, err := uuid.Parse(last)
+	if err != nil {
+		return "", err
+	}
+	// младшие 62 бита - случайная часть UUIDv7, переполнение не задевает версию
+	for i := len(prev) - 1; i >= 8; i-- {
+		prev[i]++
+		if prev[i] != 0 {
+			break
+		}
+	}
+	return prev.String(), nil
+}
+
+// ListQuery - страница истории: до Limit сообщений старше Before или новее After.
+// Без Before/After возвращаются последние Limit сообщений. Сообщения, которые
+// Viewer удалил у себя, пропускаются.
+type ListQuery struct {
+	Before string
+	After  string
+	Limit  int
+	Viewer string
+}
+
+// page выбирает страницу из сообщений, отсортированных по ID
+func (q ListQuery) page(messages []*DialogMessage) []*DialogMessage {
+	if q.After != "" {
+		from := sort.Search(len(messages), func(i int) bool { return messages[i].ID > q.After })
+		messages = messages[from:]
+		if len(messages) > q.Limit {
+			messages = messages[:q.Limit]
+		}
+		return messages
+	}
+	if q.Before != "" {
+		to := sort.Search(len(messages), func(i int) bool { return messages[i].ID >= q.Before })
+		messages = messages[:to]
+	}
+	if len(messages) > q.Limit {
+		messages = messages[len(messages)-q.Limit:]
+	}
+	return messages
+}
+
+// DialogsQuery - страница списка диалогов: до Limit диалогов, последнее сообщение
+// в которых старше Before (ID сообщения)
+type DialogsQuery struct {
+	Before string
+	Limit  int
+}
+
+// DialogSummary - строка списка диалогов; PeerID - собеседник личного диалога, Title - название группы
+type DialogSummary struct {
+	DialogKey       string    `json:"conversation_id"`
+	Kind            string    `json:"kind"`
+	PeerID          string    `json:"user_id,omitempty"`
+	Title           string    `json:"title,omitempty"`
+	LastMessageID   string    `json:"last_message_id"`
+	LastMessageFrom string    `json:"last_message_from"`
+	LastMessageText string    `json:"last_message_preview"`
+	LastMessageAt   time.Time `json:"last_message_at"`
+	Unread          int       `json:"unread"`
+}
+
+// previewLength - длина превью последнего сообщения в символах
+const previewLength = 100
+
+func messagePreview(text string) string {
+	runes := []rune(text)
+	if len(runes) <= previewLength {
+		return text
+	}
+	return string(runes[:previewLength])
+}
+
+// page сортирует диалоги по последнему сообщению (новые первыми) и выбирает страницу
+func (q DialogsQuery) page(summaries []*DialogSummary) []*DialogSummary {
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].LastMessageID > summaries[j].LastMessageID })
+	if q.Before != "" {
+		from := sort.Search(len(summaries), func(i int) bool { return summaries[i].LastMessageID < q.Before })
+		summaries = summaries[from:]
+	}
+	if len(summaries) > q.Limit {
+		summaries = summaries[:q.Limit]
+	}
+	return summaries
+}
+
+type DialogUnread struct {
+	DialogKey string `json:"conversation_id"`
+	PeerID    string `json:"user_id,omitempty"`
+	Unread    int    `json:"unread"`
+}
+
+type DialogStats struct {
+	TotalDialogs  int `json:"total_dialogs"`
+	TotalMessages int `json:"total_messages"`
+}
+
+// newDialogStore выбирает хранилище по DIALOG_STORAGE: memory (по умолчанию),
+// postgres (DIALOG_DB_URL) или sharded (DIALOG_SHARDS, см. sharding.go)
+func newDialogStore(ctx context.Context) (DialogStore, error) {
+	switch mode := os.Getenv("DIALOG_STORAGE"); mode {
+	case "", "memory":
+		log.Printf("Using in-memory dialog storage")
+		return newMemoryStore(), nil
+	case "postgres":
+		log.Printf("Using PostgreSQL dialog storage")
+		return newPostgresStore(ctx, os.Getenv("DIALOG_DB_URL"))
+	case "sharded":
+		log.Printf("Using sharded PostgreSQL dialog storage")
+		return newShardedStore(ctx)
+	default:
+		log.Fatalf("Unknown DIALOG_STORAGE %q", mode)
+		return nil, nil
+	}
+}
+
+// memoryStore - хранилище в памяти процесса, данные теряются при рестарте
+type memoryStore struct {
+	dialogs     map[string][]*DialogMessage  // dialog key -> messages
+	readCursors map[string]map[string]string // dialog key -> userId -> last read message ID
+	unread      map[string]map[string]int    // dialog key -> userId -> unread messages
+	userIndex   map[string]map[string]bool   // userId -> dialog keys
+	hidden      map[string]map[string]bool   // userId -> message IDs, удаленные у себя
+	groups      map[string]*Group            // group ID -> group
+	sent        map[idempotentSend]sentMessage
+	mu          sync.RWMutex
+}
+
+type idempotentSend struct {
+	dialogKey, userId, key string
+}
+
+type sentMessage struct {
+	messageId string
+	at        time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		dialogs:     make(map[string][]*DialogMessage),
+		readCursors: make(map[string]map[string]string),
+		unread:      make(map[string]map[string]int),
+		userIndex:   make(map[string]map[string]bool),
+		hidden:      make(map[string]map[string]bool),
+		groups:      make(map[string]*Group),
+		sent:        make(map[idempotentSend]sentMessage),
+	}
+}
+
+// members возвращает участников беседы; вызывается под блокировкой
+func (s *memoryStore) members(dialogKey string) []string {
+	if !isGroupKey(dialogKey) {
+		first, second, _ := strings.Cut(dialogKey, "_")
+		return []string{first, second}
+	}
+	var ids []string
+	if group := s.groups[dialogKey]; group != nil {
+		for _, m := range group.Members {
+			ids = append(ids, m.UserID)
+		}
+	}
+	return ids
+}
+
+// join добавляет пользователя в индекс и счетчики беседы; вызывается под блокировкой
+func (s *memoryStore) join(dialogKey, userId string) {
+	if s.userIndex[userId] == nil {
+		s.userIndex[userId] = make(map[string]bool)
+	}
+	s.userIndex[userId][dialogKey] = true
+	if s.unread[dialogKey] == nil {
+		s.unread[dialogKey] = make(map[string]int)
+	}
+	if _, ok := s.unread[dialogKey][userId]; !ok {
+		s.unread[dialogKey][userId] = 0
+	}
+}
+
+func (s *memoryStore) Append(ctx context.Context, dialogKey string, msg *DialogMessage, idempotencyKey string) (*DialogMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := s.members(dialogKey)
+	if !slices.Contains(members, msg.From) {
+		return nil, errNotMember
+	}
+	if idempotencyKey != "" {
+		send := idempotentSend{dialogKey: dialogKey, userId: msg.From, key: idempotencyKey}
+		if sent, ok := s.sent[send]; ok && time.Since(sent.at) < idempotencyWindow {
+			messages := s.dialogs[dialogKey]
+			i := sort.Search(len(messages), func(i int) bool { return messages[i].ID >= sent.messageId })
+			if i == len(messages) || messages[i].ID != sent.messageId {
+				return nil, errMessageNotFound
+			}
+			return messages[i], nil
+		}
+	}
+
+	var last string
+	if messages := s.dialogs[dialogKey]; len(messages) > 0 {
+		last = messages[len(messages)-1].ID
+	}
+	id, err := nextMessageID(last)
+	if err != nil {
+		return nil, err
+	}
+	msg.ID = id
+	if idempotencyKey != "" {
+		send := idempotentSend{dialogKey: dialogKey, userId: msg.From, key: idempotencyKey}
+		s.sent[send] = sentMessage{messageId: msg.ID, at: time.Now()}
+	}
+
+	s.dialogs[dialogKey] = append(s.dialogs[dialogKey], msg)
+	for _, userId := range members {
+		s.join(dialogKey, userId)
+		if userId != msg.From {
+			s.unread[dialogKey][userId]++
+		}
+	}
+	return msg, nil
+}
+
+func (s *memoryStore) List(ctx context.Context, dialogKey string, q ListQuery) ([]*DialogMessage, error) {
+	s.mu.RLock()
+	messages := q.page(s.visible(dialogKey, q.Viewer))
+	s.mu.RUnlock()
+	return messages, nil
+}
+
+// visible возвращает сообщения диалога без скрытых userId; вызывается под блокировкой
+func (s *memoryStore) visible(dialogKey, userId string) []*DialogMessage {
+	messages := s.dialogs[dialogKey]
+	if len(s.hidden[userId]) == 0 {
+		return messages
+	}
+	result := make([]*DialogMessage, 0, len(messages))
+	for _, m := range messages {
+		if !s.hidden[userId][m.ID] {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// findMessage ищет сообщение userId в диалоге; вызывается под блокировкой
+func (s *memoryStore) findMessage(dialogKey, userId, messageId string) (int, error) {
+	messages := s.dialogs[dialogKey]
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].ID >= messageId })
+	if i == len(messages) || messages[i].ID != messageId {
+		return i, errMessageNotFound
+	}
+	if messages[i].From != userId {
+		return i, errNotMessageAuthor
+	}
+	return i, nil
+}
+
+// Сообщения не меняются на месте: List отдает срезы наружу, поэтому Edit и Delete
+// собирают новый срез
+
+func (s *memoryStore) Edit(ctx context.Context, dialogKey, userId, messageId, text string) (*DialogMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.findMessage(dialogKey, userId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	edited := *s.dialogs[dialogKey][i]
+	now := time.Now()
+	edited.Text, edited.Edited, edited.EditedAt = text, true, &now
+
+	messages := append([]*DialogMessage(nil), s.dialogs[dialogKey]...)
+	messages[i] = &edited
+	s.dialogs[dialogKey] = messages
+	return &edited, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, dialogKey, userId, messageId string, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.findMessage(dialogKey, userId, messageId)
+	if err != nil {
+		return err
+	}
+	old := s.dialogs[dialogKey]
+	if time.Since(old[i].Timestamp) > window {
+		return errDeleteWindowExpired
+	}
+
+	messages := make([]*DialogMessage, 0, len(old)-1)
+	messages = append(messages, old[:i]...)
+	s.dialogs[dialogKey] = append(messages, old[i+1:]...)
+	for _, hidden := range s.hidden {
+		delete(hidden, messageId)
+	}
+	s.recount(dialogKey)
+	return nil
+}
+
+func (s *memoryStore) Hide(ctx context.Context, dialogKey, userId, messageId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.findMessage(dialogKey, userId, messageId); errors.Is(err, errMessageNotFound) {
+		return err
+	}
+	if s.hidden[userId] == nil {
+		s.hidden[userId] = make(map[string]bool)
+	}
+	s.hidden[userId][messageId] = true
+	s.recount(dialogKey)
+	return nil
+}
+
+// recount пересчитывает счетчики диалога; вызывается под блокировкой
+func (s *memoryStore) recount(dialogKey string) {
+	for userId := range s.unread[dialogKey] {
+		s.unread[dialogKey][userId] = s.countUnread(dialogKey, userId)
+	}
+}
+
+func (s *memoryStore) ReadCursor(ctx context.Context, dialogKey, userId string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readCursors[dialogKey][userId], nil
+}
+
+func (s *memoryStore) SetReadCursor(ctx context.Context, dialogKey, userId, messageId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := s.dialogs[dialogKey]
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].ID >= messageId })
+	if i == len(messages) || messages[i].ID != messageId {
+		return errMessageNotFound
+	}
+	if s.readCursors[dialogKey] == nil {
+		s.readCursors[dialogKey] = make(map[string]string)
+	}
+	if messageId > s.readCursors[dialogKey][userId] {
+		s.readCursors[dialogKey][userId] = messageId
+	}
+	if s.unread[dialogKey] != nil {
+		s.unread[dialogKey][userId] = s.countUnread(dialogKey, userId)
+	}
+	return nil
+}
+
+// countUnread считает сообщения пользователю после его курсора; вызывается под блокировкой
+func (s *memoryStore) countUnread(dialogKey, userId string) int {
+	cursor := s.readCursors[dialogKey][userId]
+	messages := s.visible(dialogKey, userId)
+	from := sort.Search(len(messages), func(i int) bool { return messages[i].ID > cursor })
+	n := 0
+	for _, m := range messages[from:] {
+		if m.From != userId {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memoryStore) Unread(ctx context.Context, userId string) ([]DialogUnread, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []DialogUnread{}
+	for dialogKey, counters := range s.unread {
+		if n := counters[userId]; n > 0 {
+			result = append(result, DialogUnread{DialogKey: dialogKey, PeerID: peerFromDialogKey(dialogKey, userId), Unread: n})
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Reconcile(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fixed := 0
+	for dialogKey, counters := range s.unread {
+		for userId, n := range counters {
+			if actual := s.countUnread(dialogKey, userId); actual != n {
+				counters[userId] = actual
+				fixed++
+			}
+		}
+	}
+	return fixed, nil
+}
+
+func (s *memoryStore) UserDialogs(ctx context.Context, userId string, q DialogsQuery) ([]*DialogSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	summaries := make([]*DialogSummary, 0, len(s.userIndex[userId]))
+	for dialogKey := range s.userIndex[userId] {
+		messages := s.visible(dialogKey, userId)
+		if len(messages) == 0 {
+			continue
+		}
+		last := messages[len(messages)-1]
+		summary := &DialogSummary{
+			DialogKey:       dialogKey,
+			Kind:            conversationKind(dialogKey),
+			PeerID:          peerFromDialogKey(dialogKey, userId),
+			LastMessageID:   last.ID,
+			LastMessageFrom: last.From,
+			LastMessageText: messagePreview(last.Text),
+			LastMessageAt:   last.Timestamp,
+			Unread:          s.unread[dialogKey][userId],
+		}
+		if group := s.groups[dialogKey]; group != nil {
+			summary.Title = group.Title
+		}
+		summaries = append(summaries, summary)
+	}
+	return q.page(summaries), nil
+}
+
+func (s *memoryStore) CreateGroup(ctx context.Context, group *Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups[group.ID] = group.clone()
+	for _, m := range group.Members {
+		s.join(group.ID, m.UserID)
+	}
+	return nil
+}
+
+func (s *memoryStore) Group(ctx context.Context, groupId string) (*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	group := s.groups[groupId]
+	if group == nil {
+		return nil, errConversationNotFound
+	}
+	return group.clone(), nil
+}
+
+// Группы, как и сообщения, не меняются на месте: Group отдает копию, изменения собирают новую
+
+func (s *memoryStore) AddMember(ctx context.Context, groupId, actorId string, member GroupMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.groups[groupId]
+	if group == nil {
+		return errConversationNotFound
+	}
+	if err := group.checkAdd(actorId, member.UserID); err != nil {
+		return err
+	}
+	updated := group.clone()
+	updated.Members = append(updated.Members, member)
+	s.groups[groupId] = updated
+
+	if messages := s.dialogs[groupId]; len(messages) > 0 {
+		if s.readCursors[groupId] == nil {
+			s.readCursors[groupId] = make(map[string]string)
+		}
+		s.readCursors[groupId][member.UserID] = messages[len(messages)-1].ID
+	}
+	s.join(groupId, member.UserID)
+	return nil
+}
+
+func (s *memoryStore) RemoveMember(ctx context.Context, groupId, actorId, userId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.groups[groupId]
+	if group == nil {
+		return errConversationNotFound
+	}
+	if err := group.checkRemove(actorId, userId); err != nil {
+		return err
+	}
+	updated := group.clone()
+	updated.Members = slices.DeleteFunc(updated.Members, func(m GroupMember) bool { return m.UserID == userId })
+	s.groups[groupId] = updated
+
+	delete(s.userIndex[userId], groupId)
+	delete(s.unread[groupId], userId)
+	delete(s.readCursors[groupId], userId)
+	return nil
+}
+
+func (s *memoryStore) SetMemberRole(ctx context.Context, groupId, actorId, userId, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := s.groups[groupId]
+	if group == nil {
+		return errConversationNotFound
+	}
+	if err := group.checkSetRole(actorId, userId, role); err != nil {
+		return err
+	}
+	updated := group.clone()
+	updated.Member(userId).Role = role
+	s.groups[groupId] = updated
+	return nil
+}
+
+func (s *memoryStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for send, sent := range s.sent {
+		if sent.at.Before(before) {
+			delete(s.sent, send)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Stats(ctx context.Context) (DialogStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := DialogStats{TotalDialogs: len(s.dialogs)}
+	for _, messages := range s.dialogs {
+		stats.TotalMessages += len(messages)
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) Close() {}
@@ -0,0 +1,931 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresStore хранит сообщения в таблице dialog_messages, dialog_key - ключ беседы:
+// createDialogKey для личного диалога или ID группы. ID сообщений - UUIDv7, поэтому
+// сортировка по id совпадает с порядком отправки.
+type postgresStore struct {
+	db *pgxpool.Pool
+}
+
+func newPostgresStore(ctx context.Context, url string) (*postgresStore, error) {
+	db, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("connect to dialog database: %w", err)
+	}
+
+	s := &postgresStore{db: db}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate dialog database: %w", err)
+	}
+	return s, nil
+}
+
+func (s *postgresStore) migrate(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS dialog_messages (
+			id UUID PRIMARY KEY,
+			dialog_key TEXT NOT NULL,
+			from_user TEXT NOT NULL,
+			to_user TEXT, -- получатель личного сообщения, не заполняется с появлением групп
+			text TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			edited_at TIMESTAMPTZ
+		);
+		ALTER TABLE dialog_messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ;
+		ALTER TABLE dialog_messages ALTER COLUMN to_user DROP NOT NULL;
+		CREATE INDEX IF NOT EXISTS dialog_messages_dialog_key_idx ON dialog_messages (dialog_key, id);
+		CREATE INDEX IF NOT EXISTS dialog_messages_from_user_idx ON dialog_messages (from_user);
+		CREATE INDEX IF NOT EXISTS dialog_messages_to_user_idx ON dialog_messages (to_user);
+		CREATE TABLE IF NOT EXISTS conversations (
+			dialog_key TEXT PRIMARY KEY,
+			title TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS conversation_members (
+			dialog_key TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'member',
+			joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (dialog_key, user_id)
+		);
+		CREATE TABLE IF NOT EXISTS dialog_read_cursors (
+			dialog_key TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			last_read_id UUID NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (dialog_key, user_id)
+		);
+		CREATE TABLE IF NOT EXISTS dialog_hidden_messages (
+			dialog_key TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			message_id UUID NOT NULL,
+			PRIMARY KEY (user_id, message_id)
+		);
+		CREATE INDEX IF NOT EXISTS dialog_hidden_messages_dialog_key_idx ON dialog_hidden_messages (dialog_key);
+		CREATE TABLE IF NOT EXISTS user_dialogs (
+			user_id TEXT NOT NULL,
+			dialog_key TEXT NOT NULL,
+			peer_id TEXT NOT NULL,
+			unread INT NOT NULL DEFAULT 0,
+			last_message_id UUID,
+			last_message_from TEXT,
+			last_message_preview TEXT,
+			last_message_at TIMESTAMPTZ,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp(),
+			PRIMARY KEY (user_id, dialog_key)
+		);
+		ALTER TABLE user_dialogs
+			ADD COLUMN IF NOT EXISTS last_message_id UUID,
+			ADD COLUMN IF NOT EXISTS last_message_from TEXT,
+			ADD COLUMN IF NOT EXISTS last_message_preview TEXT,
+			ADD COLUMN IF NOT EXISTS last_message_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS user_dialogs_activity_idx ON user_dialogs (user_id, last_message_id DESC);
+		CREATE INDEX IF NOT EXISTS user_dialogs_dialog_key_idx ON user_dialogs (dialog_key);
+		CREATE TABLE IF NOT EXISTS dialog_idempotency_keys (
+			dialog_key TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			message_id UUID NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (dialog_key, user_id, idempotency_key)
+		);
+		CREATE INDEX IF NOT EXISTS dialog_idempotency_keys_created_at_idx ON dialog_idempotency_keys (created_at);
+	`)
+	return err
+}
+
+// upsertDialogSQL обновляет строку диалога в индексе user_dialogs: счетчик растет на
+// $4, последнее сообщение заменяется, только если оно новее (отправки могут закоммититься
+// не по порядку ID)
+const upsertDialogSQL = `
+	INSERT INTO user_dialogs (user_id, dialog_key, peer_id, unread,
+		last_message_id, last_message_from, last_message_preview, last_message_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (user_id, dialog_key) DO UPDATE SET
+		unread = user_dialogs.unread + EXCLUDED.unread,
+		last_message_id = GREATEST(user_dialogs.last_message_id, EXCLUDED.last_message_id),
+		last_message_from = CASE WHEN ` + newerMessageSQL + ` THEN EXCLUDED.last_message_from ELSE user_dialogs.last_message_from END,
+		last_message_preview = CASE WHEN ` + newerMessageSQL + ` THEN EXCLUDED.last_message_preview ELSE user_dialogs.last_message_preview END,
+		last_message_at = CASE WHEN ` + newerMessageSQL + ` THEN EXCLUDED.last_message_at ELSE user_dialogs.last_message_at END,
+		updated_at = clock_timestamp()`
+
+const newerMessageSQL = `(user_dialogs.last_message_id IS NULL OR user_dialogs.last_message_id < EXCLUDED.last_message_id)`
+
+// Append сохраняет сообщение и строки всех участников в user_dialogs (счетчик
+// непрочитанных, последнее сообщение) в одной транзакции: таблица лежит на шарде
+// беседы, поэтому сообщение без счетчика (или наоборот) не может остаться после
+// падения и отдельный outbox не нужен. Reconcile чинит расхождения, пришедшие
+// другими путями (ручные правки, решардинг, старые данные).
+func (s *postgresStore) Append(ctx context.Context, dialogKey string, msg *DialogMessage, idempotencyKey string) (*DialogMessage, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Отправки в беседу идут по одной, чтобы ID сообщений росли в порядке коммита
+	if err := lockDialog(ctx, tx, dialogKey, true); err != nil {
+		return nil, err
+	}
+	members, err := lockMembers(ctx, tx, dialogKey, false)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(members, msg.From) {
+		return nil, errNotMember
+	}
+
+	var last string
+	err = tx.QueryRow(ctx,
+		"SELECT id::text FROM dialog_messages WHERE dialog_key = $1 ORDER BY id DESC LIMIT 1", dialogKey).Scan(&last)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	if msg.ID, err = nextMessageID(last); err != nil {
+		return nil, err
+	}
+
+	if idempotencyKey != "" {
+		sent, err := claimIdempotencyKey(ctx, tx, dialogKey, msg, idempotencyKey)
+		if err != nil || sent != nil {
+			return sent, err
+		}
+	}
+
+	if _, err := tx.Exec(ctx,
+		"INSERT INTO dialog_messages (id, dialog_key, from_user, text, created_at) VALUES ($1, $2, $3, $4, $5)",
+		msg.ID, dialogKey, msg.From, msg.Text, msg.Timestamp); err != nil {
+		return nil, err
+	}
+
+	preview := messagePreview(msg.Text)
+	batch := &pgx.Batch{}
+	for _, userId := range members {
+		unread := 1
+		if userId == msg.From {
+			unread = 0
+		}
+		batch.Queue(upsertDialogSQL,
+			userId, dialogKey, peerFromDialogKey(dialogKey, userId), unread, msg.ID, msg.From, preview, msg.Timestamp)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return nil, err
+	}
+	return msg, tx.Commit(ctx)
+}
+
+// claimIdempotencyKey закрепляет ключ за msg или, если ключ выдан в пределах
+// idempotencyWindow, возвращает сообщение, отправленное с ним. Одновременная
+// отправка с тем же ключом ждет на строке ключа до коммита первой и получает ее сообщение.
+func claimIdempotencyKey(ctx context.Context, tx pgx.Tx, dialogKey string, msg *DialogMessage, key string) (*DialogMessage, error) {
+	var claimed bool
+	err := tx.QueryRow(ctx,
+		`INSERT INTO dialog_idempotency_keys (dialog_key, user_id, idempotency_key, message_id, created_at)
+		 VALUES ($1, $2, $3, $4, now())
+		 ON CONFLICT (dialog_key, user_id, idempotency_key) DO UPDATE SET
+			message_id = EXCLUDED.message_id, created_at = EXCLUDED.created_at
+		 WHERE dialog_idempotency_keys.created_at < $5
+		 RETURNING true`,
+		dialogKey, msg.From, key, msg.ID, time.Now().Add(-idempotencyWindow)).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx,
+		`SELECT `+messageColumns+` FROM dialog_messages WHERE id = (
+			SELECT message_id FROM dialog_idempotency_keys
+			WHERE dialog_key = $1 AND user_id = $2 AND idempotency_key = $3)`,
+		dialogKey, msg.From, key)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errMessageNotFound
+	}
+	return messages[0], nil
+}
+
+func (s *postgresStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	tag, err := s.db.Exec(ctx, "DELETE FROM dialog_idempotency_keys WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// lockDialog берет advisory-блокировку беседы до конца транзакции: изменения
+// беседы - разделяемую, перенос при решардинге (moveDialog) - исключительную,
+// чтобы ни одно изменение на старом шарде не потерялось между копированием и удалением
+func lockDialog(ctx context.Context, tx pgx.Tx, dialogKey string, exclusive bool) error {
+	lock := "pg_advisory_xact_lock_shared"
+	if exclusive {
+		lock = "pg_advisory_xact_lock"
+	}
+	_, err := tx.Exec(ctx, "SELECT "+lock+"(hashtextextended($1, 0))", dialogKey)
+	return err
+}
+
+// lockMembers возвращает участников беседы. Группа блокируется до конца транзакции
+// (FOR SHARE при отправке, FOR UPDATE при смене состава), чтобы сообщение не разошлось
+// по устаревшему списку. Участники личного диалога записываются при первом сообщении.
+func lockMembers(ctx context.Context, tx pgx.Tx, dialogKey string, exclusive bool) ([]string, error) {
+	if isGroupKey(dialogKey) {
+		lock := "FOR SHARE"
+		if exclusive {
+			lock = "FOR UPDATE"
+		}
+		var exists bool
+		err := tx.QueryRow(ctx,
+			"SELECT true FROM conversations WHERE dialog_key = $1 "+lock, dialogKey).Scan(&exists)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errConversationNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(ctx, "SELECT user_id FROM conversation_members WHERE dialog_key = $1 ORDER BY user_id", dialogKey)
+	if err != nil {
+		return nil, err
+	}
+	members, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil || len(members) > 0 || isGroupKey(dialogKey) {
+		return members, err
+	}
+
+	// строки вставляются в порядке user_id, как и читаются выше, чтобы
+	// одновременные транзакции брали блокировки в одном порядке
+	first, second, _ := strings.Cut(dialogKey, "_")
+	members = []string{first, second}
+	slices.Sort(members)
+	for _, userId := range members {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO conversation_members (dialog_key, user_id) VALUES ($1, $2)
+			 ON CONFLICT DO NOTHING`,
+			dialogKey, userId); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+// messageColumns - колонки dialog_messages в порядке scanMessages
+const messageColumns = "id::text, dialog_key, from_user, text, created_at, edited_at"
+
+// notHiddenSQL исключает сообщения, которые пользователь $2 удалил у себя
+const notHiddenSQL = `NOT EXISTS (
+	SELECT 1 FROM dialog_hidden_messages h WHERE h.user_id = $2 AND h.message_id = dialog_messages.id)`
+
+func (s *postgresStore) List(ctx context.Context, dialogKey string, q ListQuery) ([]*DialogMessage, error) {
+	var rows pgx.Rows
+	var err error
+	switch {
+	case q.After != "":
+		rows, err = s.db.Query(ctx,
+			`SELECT `+messageColumns+` FROM dialog_messages
+			 WHERE dialog_key = $1 AND `+notHiddenSQL+` AND id > $3::uuid ORDER BY id LIMIT $4`,
+			dialogKey, q.Viewer, q.After, q.Limit)
+		if err != nil {
+			return nil, err
+		}
+		return scanMessages(rows)
+	case q.Before != "":
+		rows, err = s.db.Query(ctx,
+			`SELECT `+messageColumns+` FROM dialog_messages
+			 WHERE dialog_key = $1 AND `+notHiddenSQL+` AND id < $3::uuid ORDER BY id DESC LIMIT $4`,
+			dialogKey, q.Viewer, q.Before, q.Limit)
+	default:
+		rows, err = s.db.Query(ctx,
+			`SELECT `+messageColumns+` FROM dialog_messages
+			 WHERE dialog_key = $1 AND `+notHiddenSQL+` ORDER BY id DESC LIMIT $3`,
+			dialogKey, q.Viewer, q.Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Последние сообщения выбираются по убыванию ID, отдаются в порядке отправки
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// lockMessage блокирует сообщение диалога до конца транзакции и проверяет, что его отправил userId
+func lockMessage(ctx context.Context, tx pgx.Tx, dialogKey, userId, messageId string) (time.Time, error) {
+	var from string
+	var createdAt time.Time
+	err := tx.QueryRow(ctx,
+		"SELECT from_user, created_at FROM dialog_messages WHERE id = $1::uuid AND dialog_key = $2 FOR UPDATE",
+		messageId, dialogKey).Scan(&from, &createdAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return createdAt, errMessageNotFound
+	}
+	if err != nil {
+		return createdAt, err
+	}
+	if from != userId {
+		return createdAt, errNotMessageAuthor
+	}
+	return createdAt, nil
+}
+
+func (s *postgresStore) Edit(ctx context.Context, dialogKey, userId, messageId, text string) (*DialogMessage, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockDialog(ctx, tx, dialogKey, false); err != nil {
+		return nil, err
+	}
+	if _, err := lockMessage(ctx, tx, dialogKey, userId, messageId); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx,
+		`UPDATE dialog_messages SET text = $2, edited_at = now() WHERE id = $1::uuid
+		 RETURNING `+messageColumns,
+		messageId, text)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	// Превью в списке диалогов меняется, только если отредактировано последнее сообщение
+	if _, err := tx.Exec(ctx,
+		"UPDATE user_dialogs SET last_message_preview = $3 WHERE dialog_key = $1 AND last_message_id = $2::uuid",
+		dialogKey, messageId, messagePreview(text)); err != nil {
+		return nil, err
+	}
+	return messages[0], tx.Commit(ctx)
+}
+
+func (s *postgresStore) Delete(ctx context.Context, dialogKey, userId, messageId string, window time.Duration) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockDialog(ctx, tx, dialogKey, false); err != nil {
+		return err
+	}
+	createdAt, err := lockMessage(ctx, tx, dialogKey, userId, messageId)
+	if err != nil {
+		return err
+	}
+	if time.Since(createdAt) > window {
+		return errDeleteWindowExpired
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM dialog_hidden_messages WHERE message_id = $1::uuid", messageId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM dialog_messages WHERE id = $1::uuid", messageId); err != nil {
+		return err
+	}
+	if err := recountDialog(ctx, tx, dialogKey); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) Hide(ctx context.Context, dialogKey, userId, messageId string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockDialog(ctx, tx, dialogKey, false); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO dialog_hidden_messages (dialog_key, user_id, message_id)
+		 SELECT dialog_key, $3, id FROM dialog_messages WHERE id = $2::uuid AND dialog_key = $1
+		 ON CONFLICT DO NOTHING`,
+		dialogKey, messageId, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		var exists bool
+		if err := tx.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM dialog_messages WHERE id = $1::uuid AND dialog_key = $2)",
+			messageId, dialogKey).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return errMessageNotFound
+		}
+		return nil
+	}
+	if err := recountDialog(ctx, tx, dialogKey); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) ReadCursor(ctx context.Context, dialogKey, userId string) (string, error) {
+	var messageId string
+	err := s.db.QueryRow(ctx,
+		"SELECT last_read_id::text FROM dialog_read_cursors WHERE dialog_key = $1 AND user_id = $2",
+		dialogKey, userId).Scan(&messageId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return messageId, err
+}
+
+func (s *postgresStore) SetReadCursor(ctx context.Context, dialogKey, userId, messageId string) error {
+	return s.setReadCursor(ctx, dialogKey, userId, messageId, true)
+}
+
+// messageExistsSQL - сообщение с ID $2 есть в диалоге $1
+const messageExistsSQL = "SELECT 1 FROM dialog_messages WHERE dialog_key = $1 AND id = $2::uuid"
+
+// MessageExists возвращает errMessageNotFound, если в диалоге нет сообщения messageId
+func (s *postgresStore) MessageExists(ctx context.Context, dialogKey, messageId string) error {
+	err := s.db.QueryRow(ctx, messageExistsSQL, dialogKey, messageId).Scan(new(int))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errMessageNotFound
+	}
+	return err
+}
+
+// setReadCursor без verify не проверяет, что сообщение есть в диалоге: так курсоры
+// переносятся при решардинге, где сообщение под курсором могло быть уже удалено.
+// Иначе чужой или выдуманный ID из-за GREATEST навсегда увел бы курсор вперед.
+func (s *postgresStore) setReadCursor(ctx context.Context, dialogKey, userId, messageId string, verify bool) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockDialog(ctx, tx, dialogKey, false); err != nil {
+		return err
+	}
+	if verify {
+		err := tx.QueryRow(ctx, messageExistsSQL, dialogKey, messageId).Scan(new(int))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var lastReadId string
+	err = tx.QueryRow(ctx,
+		`INSERT INTO dialog_read_cursors (dialog_key, user_id, last_read_id) VALUES ($1, $2, $3::uuid)
+		 ON CONFLICT (dialog_key, user_id) DO UPDATE
+		 SET last_read_id = GREATEST(dialog_read_cursors.last_read_id, EXCLUDED.last_read_id), updated_at = now()
+		 RETURNING last_read_id::text`,
+		dialogKey, userId, messageId).Scan(&lastReadId)
+	if err != nil {
+		return err
+	}
+
+	// Счетчик пересчитывается от курсора, а не уменьшается на размер страницы,
+	// поэтому повторное или параллельное чтение не уводит его в минус
+	if _, err := tx.Exec(ctx,
+		`UPDATE user_dialogs SET unread = (
+			SELECT count(*) FROM dialog_messages
+			WHERE dialog_key = $1 AND from_user <> $2 AND id > $3::uuid AND `+notHiddenSQL+`
+		 ), updated_at = clock_timestamp()
+		 WHERE user_id = $2 AND dialog_key = $1`,
+		dialogKey, userId, lastReadId); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) Unread(ctx context.Context, userId string) ([]DialogUnread, error) {
+	rows, err := s.db.Query(ctx,
+		`SELECT dialog_key, peer_id, unread FROM user_dialogs
+		 WHERE user_id = $1 AND unread > 0 ORDER BY last_message_id DESC`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (DialogUnread, error) {
+		var u DialogUnread
+		err := row.Scan(&u.DialogKey, &u.PeerID, &u.Unread)
+		return u, err
+	})
+}
+
+// actualDialogsSQL - фактические строки user_dialogs (счетчик по сообщениям и курсорам
+// прочтения, последнее сообщение) для диалогов, подходящих под условие %[1]s.
+// Участники - conversation_members, для личных диалогов без этих строк (сообщения
+// до появления групп) - обе половины ключа. Сообщения, скрытые участником у себя,
+// в его строке не учитываются.
+const actualDialogsSQL = `
+	WITH participants AS (
+		SELECT dialog_key, user_id FROM conversation_members WHERE %[1]s
+		UNION
+		SELECT DISTINCT dialog_key, split_part(dialog_key, '_', 1) FROM dialog_messages
+		WHERE position('_' in dialog_key) > 0 AND %[1]s
+		UNION
+		SELECT DISTINCT dialog_key, split_part(dialog_key, '_', 2) FROM dialog_messages
+		WHERE position('_' in dialog_key) > 0 AND %[1]s
+	)
+	SELECT p.user_id, p.dialog_key, CASE
+		WHEN position('_' in p.dialog_key) = 0 THEN ''
+		WHEN split_part(p.dialog_key, '_', 1) = p.user_id THEN split_part(p.dialog_key, '_', 2)
+		ELSE split_part(p.dialog_key, '_', 1)
+	END, (
+		SELECT count(*) FROM dialog_messages m
+		WHERE m.dialog_key = p.dialog_key AND m.from_user <> p.user_id
+		  AND (c.last_read_id IS NULL OR m.id > c.last_read_id)
+		  AND NOT EXISTS (SELECT 1 FROM dialog_hidden_messages h WHERE h.user_id = p.user_id AND h.message_id = m.id)
+	) AS unread, l.id, l.from_user, left(l.text, %[2]d), l.created_at
+	FROM participants p
+	LEFT JOIN dialog_read_cursors c ON c.dialog_key = p.dialog_key AND c.user_id = p.user_id
+	LEFT JOIN LATERAL (
+		SELECT id, from_user, text, created_at FROM dialog_messages m
+		WHERE m.dialog_key = p.dialog_key
+		  AND NOT EXISTS (SELECT 1 FROM dialog_hidden_messages h WHERE h.user_id = p.user_id AND h.message_id = m.id)
+		ORDER BY id DESC LIMIT 1
+	) l ON true`
+
+// setActualDialogSQL - ON CONFLICT-часть, заменяющая строку фактическими значениями
+const setActualDialogSQL = `
+	ON CONFLICT (user_id, dialog_key) DO UPDATE SET
+		unread = EXCLUDED.unread,
+		last_message_id = EXCLUDED.last_message_id,
+		last_message_from = EXCLUDED.last_message_from,
+		last_message_preview = EXCLUDED.last_message_preview,
+		last_message_at = EXCLUDED.last_message_at,
+		updated_at = clock_timestamp()`
+
+const insertDialogsSQL = `
+	INSERT INTO user_dialogs (user_id, dialog_key, peer_id, unread,
+		last_message_id, last_message_from, last_message_preview, last_message_at)`
+
+// reconcileGrace - строки, менявшиеся позже, пропускаются: их транзакция могла
+// закоммититься после снимка, по которому считался фактический счетчик
+const reconcileGrace = time.Minute
+
+// reconcileLockId - advisory lock, чтобы сверку на шарде одновременно вел один экземпляр
+const reconcileLockId = 0x6469616c6f67 // "dialog"
+
+// reconcileBatch - диалогов на транзакцию сверки: длинная транзакция по всему
+// шарду держала бы снимок и блокировки строк user_dialogs на все время сверки
+const reconcileBatch = 500
+
+// reconcileKeysSQL - следующие $2 ключей диалогов после $1 из всех таблиц, по которым идет сверка
+const reconcileKeysSQL = `
+	SELECT dialog_key FROM (
+		(SELECT DISTINCT dialog_key FROM dialog_messages WHERE dialog_key > $1 ORDER BY dialog_key LIMIT $2)
+		UNION
+		(SELECT DISTINCT dialog_key FROM conversation_members WHERE dialog_key > $1 ORDER BY dialog_key LIMIT $2)
+		UNION
+		(SELECT DISTINCT dialog_key FROM user_dialogs WHERE dialog_key > $1 ORDER BY dialog_key LIMIT $2)
+	) keys ORDER BY dialog_key LIMIT $2`
+
+// Reconcile сверяет диалоги пачками по reconcileBatch ключей, каждая пачка - своя транзакция
+func (s *postgresStore) Reconcile(ctx context.Context) (int, error) {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", reconcileLockId).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", reconcileLockId)
+
+	fixed := 0
+	after := ""
+	for {
+		rows, err := conn.Query(ctx, reconcileKeysSQL, after, reconcileBatch)
+		if err != nil {
+			return fixed, err
+		}
+		keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fixed, err
+		}
+		if len(keys) == 0 {
+			return fixed, nil
+		}
+		n, err := reconcileDialogs(ctx, conn, keys)
+		if err != nil {
+			return fixed, err
+		}
+		fixed += n
+		if len(keys) < reconcileBatch {
+			return fixed, nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// reconcileDialogs сверяет строки user_dialogs диалогов keys в одной транзакции
+func reconcileDialogs(ctx context.Context, conn *pgxpool.Conn, keys []string) (int, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	grace := time.Now().Add(-reconcileGrace)
+	upserted, err := tx.Exec(ctx,
+		fmt.Sprintf(insertDialogsSQL+actualDialogsSQL, "dialog_key = ANY($2)", previewLength)+setActualDialogSQL+`
+		WHERE (user_dialogs.unread <> EXCLUDED.unread
+		       OR user_dialogs.last_message_id IS DISTINCT FROM EXCLUDED.last_message_id)
+		  AND user_dialogs.updated_at < $1`,
+		grace, keys)
+	if err != nil {
+		return 0, err
+	}
+	orphaned, err := tx.Exec(ctx,
+		`DELETE FROM user_dialogs ud WHERE ud.dialog_key = ANY($2) AND updated_at < $1
+		 AND NOT EXISTS (SELECT 1 FROM conversation_members cm WHERE cm.dialog_key = ud.dialog_key AND cm.user_id = ud.user_id)
+		 AND NOT (position('_' in ud.dialog_key) > 0
+		          AND EXISTS (SELECT 1 FROM dialog_messages m WHERE m.dialog_key = ud.dialog_key))`,
+		grace, keys)
+	if err != nil {
+		return 0, err
+	}
+	return int(upserted.RowsAffected() + orphaned.RowsAffected()), tx.Commit(ctx)
+}
+
+// recountDialog заново строит строки user_dialogs одного диалога: после удаления
+// сообщений или переноса диалога на другой шард
+func recountDialog(ctx context.Context, tx pgx.Tx, dialogKey string) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM user_dialogs WHERE dialog_key = $1", dialogKey); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx,
+		fmt.Sprintf(insertDialogsSQL+actualDialogsSQL, "dialog_key = $1", previewLength),
+		dialogKey)
+	return err
+}
+
+// UserDialogs читает индекс user_dialogs: строка на диалог, без обращения к сообщениям
+func (s *postgresStore) UserDialogs(ctx context.Context, userId string, q DialogsQuery) ([]*DialogSummary, error) {
+	var rows pgx.Rows
+	var err error
+	if q.Before != "" {
+		rows, err = s.db.Query(ctx,
+			`SELECT `+summaryColumns+` FROM user_dialogs ud
+			 LEFT JOIN conversations c ON c.dialog_key = ud.dialog_key
+			 WHERE ud.user_id = $1 AND ud.last_message_id < $2::uuid
+			 ORDER BY ud.last_message_id DESC LIMIT $3`,
+			userId, q.Before, q.Limit)
+	} else {
+		rows, err = s.db.Query(ctx,
+			`SELECT `+summaryColumns+` FROM user_dialogs ud
+			 LEFT JOIN conversations c ON c.dialog_key = ud.dialog_key
+			 WHERE ud.user_id = $1 AND ud.last_message_id IS NOT NULL
+			 ORDER BY ud.last_message_id DESC LIMIT $2`,
+			userId, q.Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*DialogSummary, error) {
+		d := &DialogSummary{}
+		err := row.Scan(&d.DialogKey, &d.PeerID, &d.Title, &d.LastMessageID, &d.LastMessageFrom, &d.LastMessageText, &d.LastMessageAt, &d.Unread)
+		d.Kind = conversationKind(d.DialogKey)
+		return d, err
+	})
+}
+
+const summaryColumns = `ud.dialog_key, ud.peer_id, COALESCE(c.title, ''), ud.last_message_id::text,
+	ud.last_message_from, ud.last_message_preview, ud.last_message_at, ud.unread`
+
+func (s *postgresStore) CreateGroup(ctx context.Context, group *Group) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		"INSERT INTO conversations (dialog_key, title, created_by, created_at) VALUES ($1, $2, $3, $4)",
+		group.ID, group.Title, group.CreatedBy, group.CreatedAt); err != nil {
+		return err
+	}
+	batch := &pgx.Batch{}
+	for _, m := range group.Members {
+		batch.Queue("INSERT INTO conversation_members (dialog_key, user_id, role) VALUES ($1, $2, $3)",
+			group.ID, m.UserID, m.Role)
+		batch.Queue("INSERT INTO user_dialogs (user_id, dialog_key, peer_id) VALUES ($1, $2, '')",
+			m.UserID, group.ID)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) Group(ctx context.Context, groupId string) (*Group, error) {
+	group := &Group{ID: groupId}
+	err := s.db.QueryRow(ctx,
+		"SELECT title, created_by, created_at FROM conversations WHERE dialog_key = $1",
+		groupId).Scan(&group.Title, &group.CreatedBy, &group.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx,
+		"SELECT user_id, role FROM conversation_members WHERE dialog_key = $1 ORDER BY joined_at, user_id",
+		groupId)
+	if err != nil {
+		return nil, err
+	}
+	group.Members, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (GroupMember, error) {
+		var m GroupMember
+		err := row.Scan(&m.UserID, &m.Role)
+		return m, err
+	})
+	return group, err
+}
+
+func (s *postgresStore) AddMember(ctx context.Context, groupId, actorId string, member GroupMember) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockDialog(ctx, tx, groupId, false); err != nil {
+		return err
+	}
+	group, err := lockGroup(ctx, tx, groupId)
+	if err != nil {
+		return err
+	}
+	if err := group.checkAdd(actorId, member.UserID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx,
+		"INSERT INTO conversation_members (dialog_key, user_id, role) VALUES ($1, $2, $3)",
+		groupId, member.UserID, member.Role); err != nil {
+		return err
+	}
+	// Новый участник видит историю, но непрочитанными считаются только сообщения после вступления
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO dialog_read_cursors (dialog_key, user_id, last_read_id)
+		 SELECT dialog_key, $2, max(id) FROM dialog_messages WHERE dialog_key = $1 GROUP BY dialog_key
+		 ON CONFLICT (dialog_key, user_id) DO UPDATE SET last_read_id = EXCLUDED.last_read_id, updated_at = now()`,
+		groupId, member.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		fmt.Sprintf(insertDialogsSQL+actualDialogsSQL, "dialog_key = $1", previewLength)+` WHERE p.user_id = $2`+setActualDialogSQL,
+		groupId, member.UserID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) RemoveMember(ctx context.Context, groupId, actorId, userId string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockDialog(ctx, tx, groupId, false); err != nil {
+		return err
+	}
+	group, err := lockGroup(ctx, tx, groupId)
+	if err != nil {
+		return err
+	}
+	if err := group.checkRemove(actorId, userId); err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	for _, table := range []string{"conversation_members", "user_dialogs", "dialog_read_cursors"} {
+		batch.Queue("DELETE FROM "+table+" WHERE dialog_key = $1 AND user_id = $2", groupId, userId)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) SetMemberRole(ctx context.Context, groupId, actorId, userId, role string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockDialog(ctx, tx, groupId, false); err != nil {
+		return err
+	}
+	group, err := lockGroup(ctx, tx, groupId)
+	if err != nil {
+		return err
+	}
+	if err := group.checkSetRole(actorId, userId, role); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE conversation_members SET role = $3 WHERE dialog_key = $1 AND user_id = $2",
+		groupId, userId, role); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// lockGroup блокирует состав группы до конца транзакции (lockMembers) и
+// возвращает участников с ролями для проверок checkAdd, checkRemove, checkSetRole
+func lockGroup(ctx context.Context, tx pgx.Tx, groupId string) (*Group, error) {
+	if _, err := lockMembers(ctx, tx, groupId, true); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx,
+		"SELECT user_id, role FROM conversation_members WHERE dialog_key = $1 ORDER BY user_id", groupId)
+	if err != nil {
+		return nil, err
+	}
+	members, err := pgx.CollectRows(rows, pgx.RowToStructByPos[GroupMember])
+	if err != nil {
+		return nil, err
+	}
+	return &Group{ID: groupId, Members: members}, nil
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, "SELECT 1")
+	return err
+}
+
+// Stats оценивает число сообщений и диалогов по pg_class и pg_stats без
+// чтения таблицы; оценки обновляются autovacuum (ANALYZE)
+func (s *postgresStore) Stats(ctx context.Context) (DialogStats, error) {
+	var stats DialogStats
+	err := s.db.QueryRow(ctx, `
+		SELECT GREATEST(c.reltuples, 0)::bigint,
+		       COALESCE((SELECT CASE WHEN st.n_distinct >= 0 THEN st.n_distinct
+		                             ELSE -st.n_distinct * GREATEST(c.reltuples, 0) END
+		                 FROM pg_stats st
+		                 WHERE st.schemaname = n.nspname AND st.tablename = c.relname AND st.attname = 'dialog_key'), 0)::bigint
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = 'dialog_messages'::regclass`).
+		Scan(&stats.TotalMessages, &stats.TotalDialogs)
+	return stats, err
+}
+
+func (s *postgresStore) Close() {
+	s.db.Close()
+}
+
+func scanMessages(rows pgx.Rows) ([]*DialogMessage, error) {
+	defer rows.Close()
+	messages := []*DialogMessage{}
+	for rows.Next() {
+		m := &DialogMessage{}
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.From, &m.Text, &m.Timestamp, &m.EditedAt); err != nil {
+			return nil, err
+		}
+		m.Edited = m.EditedAt != nil
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
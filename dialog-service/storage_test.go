@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNextMessageID(t *testing.T) {
+	first, err := nextMessageID("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := nextMessageID(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second <= first {
+		t.Fatalf("%s is not after %s", second, first)
+	}
+
+	// последний ID из будущего, например после перевода часов назад
+	tests := []struct{ last, want string }{
+		{"ffffffff-ffff-7fff-bfff-fffffffffff0", "ffffffff-ffff-7fff-bfff-fffffffffff1"},
+		{"ffffffff-ffff-7fff-b0ff-ffffffffffff", "ffffffff-ffff-7fff-b100-000000000000"},
+	}
+	for _, tt := range tests {
+		got, err := nextMessageID(tt.last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("nextMessageID(%s) = %s, want %s", tt.last, got, tt.want)
+		}
+	}
+}
+
+func TestSetReadCursorRejectsUnknownMessage(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	dialogKey, otherKey := createDialogKey("a", "b"), createDialogKey("a", "c")
+
+	read, err := store.Append(ctx, dialogKey, &DialogMessage{From: "b", Text: "first"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetReadCursor(ctx, dialogKey, "a", read.ID); err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := store.Append(ctx, otherKey, &DialogMessage{From: "c", Text: "other dialog"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ name, messageId string }{
+		{"message of another dialog", foreign.ID},
+		{"made-up ID", "ffffffff-ffff-7fff-bfff-ffffffffffff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.SetReadCursor(ctx, dialogKey, "a", tt.messageId); !errors.Is(err, errMessageNotFound) {
+				t.Fatalf("err = %v, want errMessageNotFound", err)
+			}
+			cursor, err := store.ReadCursor(ctx, dialogKey, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cursor != read.ID {
+				t.Fatalf("cursor = %s, want %s", cursor, read.ID)
+			}
+		})
+	}
+}
+
+func TestInvalidReadKeepsUnread(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	dialogKey := createDialogKey("a", "b")
+	for _, text := range []string{"one", "two", "three"} {
+		if _, err := store.Append(ctx, dialogKey, &DialogMessage{From: "b", Text: text}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// выдуманный ID больше любого настоящего: раньше он обнулял счетчик
+	if err := store.SetReadCursor(ctx, dialogKey, "a", "ffffffff-ffff-7fff-bfff-ffffffffffff"); !errors.Is(err, errMessageNotFound) {
+		t.Fatalf("err = %v, want errMessageNotFound", err)
+	}
+	unread, err := store.Unread(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unread) != 1 || unread[0].Unread != 3 {
+		t.Fatalf("unread = %+v, want 3 in %s", unread, dialogKey)
+	}
+}
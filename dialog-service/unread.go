@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Счетчики непрочитанных: Append увеличивает счетчик получателя в той же
+// транзакции, что и сохраняет сообщение, чтение через getDialog двигает курсор
+// прочтения и пересчитывает счетчик от курсора. Фоновая сверка (Reconcile)
+// раз в DIALOG_RECONCILE_INTERVAL (10m, 0 - выключено) пересчитывает счетчики
+// по сообщениям и чинит расхождения.
+func runReconciler(ctx context.Context, store DialogStore) {
+	interval := envDuration("DIALOG_RECONCILE_INTERVAL", 10*time.Minute)
+	if interval <= 0 {
+		log.Printf("Unread counters reconciliation disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fixed, err := store.Reconcile(ctx)
+		if err != nil {
+			log.Printf("Unread counters reconciliation failed: %v", err)
+			continue
+		}
+		if fixed > 0 {
+			log.Printf("Unread counters reconciliation repaired %d counters", fixed)
+		}
+	}
+}
@@ -4,7 +4,11 @@ go 1.23.0
 
 toolchain go1.24.9
 
-require gonum.org/v1/plot v0.16.0
+require (
+	github.com/jackc/pgx/v5 v5.7.6
+	gonum.org/v1/plot v0.16.0
+	social-network-common v0.0.0-00010101000000-000000000000
+)
 
 require (
 	codeberg.org/go-fonts/liberation v0.5.0 // indirect
@@ -14,7 +18,12 @@ require (
 	github.com/ajstarks/svgo v0.0.0-20211024235047-1546f124cd8b // indirect
 	github.com/campoy/embedmd v1.0.0 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.37.0 // indirect
 	golang.org/x/image v0.25.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 )
+
+replace social-network-common => ./common
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"social-network-common/env"
+)
+
+// Dialog-service endpoints come from DIALOG_SERVICE_URLS (comma separated,
+// DIALOG_SERVICE_URL for a single one) or, if DIALOG_SERVICE_SRV is set, from
+// its DNS SRV records re-read every DIALOG_DISCOVERY_INTERVAL. Every endpoint's
+// /health is polled each DIALOG_HEALTH_INTERVAL; an endpoint that fails the
+// check or a request at the transport level leaves the rotation until it
+// passes a check again.
+//
+// Requests for one conversation (/dialog/:user_id/..., /group/:group_id/...)
+// go to the same endpoint picked by rendezvous hashing of the dialog key, so
+// a dead endpoint only moves its own conversations. Everything else is spread
+// by DIALOG_BALANCER: round-robin (default) or least-connections.
+// DIALOG_AFFINITY=off turns the dialog key routing off.
+const (
+	balancerRoundRobin       = "round-robin"
+	balancerLeastConnections = "least-connections"
+)
+
+var errNoDialogEndpoints = errors.New("no healthy dialog service endpoints")
+
+var dialogEndpoints = newDialogPool()
+
+type dialogEndpoint struct {
+	url      *url.URL
+	inflight atomic.Int64
+
+	// guarded by dialogPool.mu
+	healthy   bool
+	lastError string
+
+	grpcMu   sync.Mutex
+	grpcConn *grpc.ClientConn // see dialoggrpc.go
+}
+
+type dialogPool struct {
+	policy   string
+	affinity bool
+	next     atomic.Uint64
+
+	mu        sync.RWMutex
+	endpoints []*dialogEndpoint // sorted by URL
+}
+
+func newDialogPool() *dialogPool {
+	p := &dialogPool{
+		policy:   env.OrDefault("DIALOG_BALANCER", balancerRoundRobin),
+		affinity: os.Getenv("DIALOG_AFFINITY") != "off",
+	}
+	if p.policy != balancerRoundRobin && p.policy != balancerLeastConnections {
+		log.Printf("Unknown DIALOG_BALANCER %q, using %s", p.policy, balancerRoundRobin)
+		p.policy = balancerRoundRobin
+	}
+
+	if os.Getenv("DIALOG_SERVICE_SRV") == "" {
+		urls := os.Getenv("DIALOG_SERVICE_URLS")
+		if urls == "" {
+			urls = env.OrDefault("DIALOG_SERVICE_URL", "http://dialog-service:8081")
+		}
+		p.set(strings.Split(urls, ","))
+	}
+	return p
+}
+
+// set replaces the endpoint list; known endpoints keep their health state
+func (p *dialogPool) set(rawURLs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	known := make(map[string]*dialogEndpoint, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		known[ep.url.String()] = ep
+	}
+
+	endpoints := make([]*dialogEndpoint, 0, len(rawURLs))
+	for _, raw := range rawURLs {
+		raw = strings.TrimSuffix(strings.TrimSpace(raw), "/")
+		if raw == "" {
+			continue
+		}
+		if ep := known[raw]; ep != nil {
+			endpoints = append(endpoints, ep)
+			delete(known, raw)
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			log.Printf("Invalid dialog service endpoint %q: %v", raw, err)
+			continue
+		}
+		log.Printf("Dialog service endpoint %s added", raw)
+		// Healthy until the first check says otherwise, so requests work right after startup
+		endpoints = append(endpoints, &dialogEndpoint{url: u, healthy: true})
+	}
+	for raw, ep := range known {
+		log.Printf("Dialog service endpoint %s removed", raw)
+		ep.closeGRPC()
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].url.String() < endpoints[j].url.String() })
+	p.endpoints = endpoints
+}
+
+func (p *dialogPool) all() []*dialogEndpoint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.endpoints
+}
+
+// pick chooses an endpoint for a request; dialogKey is "" for requests not bound to a conversation
+func (p *dialogPool) pick(dialogKey string) (*dialogEndpoint, error) {
+	p.mu.RLock()
+	healthy := make([]*dialogEndpoint, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		if ep.healthy {
+			healthy = append(healthy, ep)
+		}
+	}
+	p.mu.RUnlock()
+	if len(healthy) == 0 {
+		return nil, errNoDialogEndpoints
+	}
+
+	if dialogKey != "" && p.affinity {
+		var best *dialogEndpoint
+		var bestScore uint64
+		for _, ep := range healthy {
+			h := fnv.New64a()
+			io.WriteString(h, ep.url.String())
+			io.WriteString(h, dialogKey)
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = ep, score
+			}
+		}
+		return best, nil
+	}
+
+	start := int(p.next.Add(1) % uint64(len(healthy)))
+	if p.policy == balancerRoundRobin {
+		return healthy[start], nil
+	}
+	// least-connections; scanning from the round-robin position spreads ties
+	best := healthy[start]
+	for i := 1; i < len(healthy); i++ {
+		if ep := healthy[(start+i)%len(healthy)]; ep.inflight.Load() < best.inflight.Load() {
+			best = ep
+		}
+	}
+	return best, nil
+}
+
+func (p *dialogPool) setHealth(ep *dialogEndpoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	healthy := err == nil
+	if healthy != ep.healthy {
+		if healthy {
+			log.Printf("Dialog service endpoint %s is back", ep.url)
+		} else {
+			log.Printf("Dialog service endpoint %s removed from rotation: %v", ep.url, err)
+		}
+	}
+	ep.healthy = healthy
+	ep.lastError = ""
+	if err != nil {
+		ep.lastError = err.Error()
+	}
+}
+
+type endpointStatus struct {
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Inflight  int64  `json:"inflight"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (p *dialogPool) status() []endpointStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	result := make([]endpointStatus, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		result = append(result, endpointStatus{
+			URL:       ep.url.String(),
+			Healthy:   ep.healthy,
+			Inflight:  ep.inflight.Load(),
+			LastError: ep.lastError,
+		})
+	}
+	return result
+}
+
+type dialogServiceStatus struct {
+	breakerStatus
+	Balancer  string           `json:"balancer"`
+	Endpoints []endpointStatus `json:"endpoints"`
+}
+
+// startDialogDiscovery resolves the endpoints once before the monolith starts serving
+// and keeps them and their health up to date in the background
+func startDialogDiscovery(ctx context.Context) {
+	if srv := os.Getenv("DIALOG_SERVICE_SRV"); srv != "" {
+		if err := discoverDialogEndpoints(ctx, dialogEndpoints, srv); err != nil {
+			log.Printf("Dialog service discovery via SRV %s failed: %v", srv, err)
+		}
+		go func() {
+			ticker := time.NewTicker(envDuration("DIALOG_DISCOVERY_INTERVAL", 30*time.Second))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if err := discoverDialogEndpoints(ctx, dialogEndpoints, srv); err != nil {
+					log.Printf("Dialog service discovery via SRV %s failed: %v", srv, err)
+				}
+			}
+		}()
+	}
+
+	go checkDialogEndpoints(ctx, dialogEndpoints, envDuration("DIALOG_HEALTH_INTERVAL", 5*time.Second))
+}
+
+// discoverDialogEndpoints reads SRV records; on an error or an empty answer the current list is kept
+func discoverDialogEndpoints(ctx context.Context, p *dialogPool, srv string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", srv)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("no SRV records")
+	}
+	urls := make([]string, 0, len(records))
+	for _, r := range records {
+		urls = append(urls, fmt.Sprintf("http://%s", net.JoinHostPort(strings.TrimSuffix(r.Target, "."), fmt.Sprint(r.Port))))
+	}
+	p.set(urls)
+	return nil
+}
+
+var healthClient = &http.Client{Timeout: time.Second}
+
+func checkDialogEndpoints(ctx context.Context, p *dialogPool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, ep := range p.all() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.setHealth(ep, checkDialogEndpoint(ctx, ep))
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkDialogEndpoint(ctx context.Context, ep *dialogEndpoint) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.url.String()+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+type dialogKeyContextKey struct{}
+
+// withDialogKey binds the request to a conversation for endpoint affinity
+func withDialogKey(ctx context.Context, dialogKey string) context.Context {
+	return context.WithValue(ctx, dialogKeyContextKey{}, dialogKey)
+}
+
+// dialogRoutingKey returns the conversation a proxied request belongs to, the
+// same key dialog-service uses: "<user1>_<user2>" or the group ID
+func dialogRoutingKey(userId, urlPath string) string {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	switch {
+	case parts[0] == "dialog" && parts[1] != "unread":
+		if userId < parts[1] {
+			return userId + "_" + parts[1]
+		}
+		return parts[1] + "_" + userId
+	case parts[0] == "group":
+		return parts[1]
+	}
+	return ""
+}
+
+// balancedTransport sends each attempt to an endpoint picked from the pool
+type balancedTransport struct {
+	pool *dialogPool
+	base http.RoundTripper
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dialogKey, _ := req.Context().Value(dialogKeyContextKey{}).(string)
+	ep, err := t.pool.pick(dialogKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme, out.URL.Host, out.Host = ep.url.Scheme, ep.url.Host, ""
+
+	ep.inflight.Add(1)
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		ep.inflight.Add(-1)
+		if req.Context().Err() == nil {
+			t.pool.setHealth(ep, err)
+		}
+		return nil, err
+	}
+	resp.Body = &inflightBody{ReadCloser: resp.Body, ep: ep}
+	return resp, nil
+}
+
+// inflightBody keeps the request counted as in flight until its response body is closed
+type inflightBody struct {
+	io.ReadCloser
+	ep   *dialogEndpoint
+	once sync.Once
+}
+
+func (b *inflightBody) Close() error {
+	b.once.Do(func() { b.ep.inflight.Add(-1) })
+	return b.ReadCloser.Close()
+}
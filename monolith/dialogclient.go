@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// Transport to dialog-service shared by all proxied requests: pooled keep-alive
+// connections, a timeout per route, bounded retries and a circuit breaker.
+//
+// Each attempt goes to an endpoint picked by balancedTransport (dialogbalancer.go),
+// so a retry after a transport error lands on another one.
+//
+// Only requests that can be replayed are retried: idempotent methods and sends
+// carrying an Idempotency-Key, with an empty or buffered body. A retry waits a random part of an exponentially growing backoff
+// (full jitter) so instances don't retry in lockstep.
+//
+// The breaker opens after DIALOG_BREAKER_FAILURES consecutive failed attempts
+// (transport errors, timeouts, 502/503/504). While it is open requests fail
+// right away with 503 and Retry-After. After DIALOG_BREAKER_COOLDOWN one probe
+// request is let through: success closes the breaker, failure opens it again.
+var (
+	dialogTimeout     = envDuration("DIALOG_TIMEOUT", 5*time.Second)
+	dialogMaxAttempts = envInt("DIALOG_MAX_ATTEMPTS", 3)
+	dialogRetryBase   = envDuration("DIALOG_RETRY_BACKOFF", 50*time.Millisecond)
+
+	dialogBreaker = newCircuitBreaker(
+		envInt("DIALOG_BREAKER_FAILURES", 5),
+		envDuration("DIALOG_BREAKER_COOLDOWN", 10*time.Second))
+
+	dialogTransport = &retryTransport{
+		base: &balancedTransport{
+			pool: dialogEndpoints,
+			base: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   2 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: envInt("DIALOG_MAX_IDLE_CONNS", 32),
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		breaker:     dialogBreaker,
+		maxAttempts: dialogMaxAttempts,
+		backoff:     dialogRetryBase,
+	}
+)
+
+// dialogRouteTimeouts overrides DIALOG_TIMEOUT for some routes; the first match wins
+var dialogRouteTimeouts = []struct {
+	method  string
+	pattern string // path.Match pattern
+	timeout time.Duration
+}{
+	{http.MethodGet, "/dialog/unread", time.Second},
+	{http.MethodGet, "/dialogs/unread", time.Second},
+	{http.MethodGet, "/dialog/*/list", 3 * time.Second},
+	{http.MethodGet, "/group/*/list", 3 * time.Second},
+	{http.MethodGet, "/dialogs", 3 * time.Second},
+	{http.MethodPost, "/groups", 10 * time.Second},
+	{http.MethodPost, "/group/*/members", 10 * time.Second},
+}
+
+func dialogRouteTimeout(method, urlPath string) time.Duration {
+	for _, rt := range dialogRouteTimeouts {
+		if rt.method != method {
+			continue
+		}
+		if ok, _ := path.Match(rt.pattern, urlPath); ok {
+			return rt.timeout
+		}
+	}
+	return dialogTimeout
+}
+
+type retryTransport struct {
+	base        http.RoundTripper
+	breaker     *circuitBreaker
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if wait, ok := t.breaker.allow(); !ok {
+			return nil, &breakerOpenError{retryAfter: wait}
+		}
+
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				t.breaker.release()
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		failed := dialogAttemptFailed(resp, err)
+		if err != nil && errors.Is(req.Context().Err(), context.Canceled) {
+			// The caller went away, that says nothing about the backend
+			t.breaker.release()
+			return nil, err
+		}
+		t.breaker.record(failed)
+
+		if !failed || attempt >= t.maxAttempts || !replayable(req) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+
+		delay := time.Duration(rand.Int63n(int64(t.backoff<<(attempt-1)) + 1))
+		log.Printf("Dialog service %s %s attempt %d failed (%s), retrying in %s",
+			req.Method, req.URL.Path, attempt, dialogFailure(resp, err), delay)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func dialogAttemptFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func dialogFailure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+// replayable: the request can be sent again without changing the outcome
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		if req.Header.Get(idempotencyKeyHeader) == "" {
+			return false
+		}
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+type breakerOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("dialog service circuit breaker is open, retry after %s", e.retryAfter)
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int // consecutive
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// allow reports whether a request may go to the backend and, if not, how long to wait
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if wait := time.Until(b.openUntil); wait > 0 {
+			return wait, false
+		}
+		b.state = breakerHalfOpen
+		log.Printf("Dialog service circuit breaker half-open, probing")
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return time.Second, false
+		}
+		b.probing = true
+	}
+	return 0, true
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.state != breakerClosed {
+			log.Printf("Dialog service circuit breaker closed")
+		}
+		b.state, b.failures, b.probing = breakerClosed, 0, false
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			log.Printf("Dialog service circuit breaker open for %s after %d failures", b.cooldown, b.failures)
+		}
+		b.state, b.openUntil, b.probing = breakerOpen, time.Now().Add(b.cooldown), false
+	}
+}
+
+// release gives up the probe slot without an outcome
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+type breakerStatus struct {
+	State      breakerState `json:"state"`
+	Failures   int          `json:"consecutive_failures"`
+	RetryAfter int          `json:"retry_after_seconds,omitempty"`
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := breakerStatus{State: b.state, Failures: b.failures}
+	if b.state == breakerOpen {
+		s.RetryAfter = retryAfterSeconds(time.Until(b.openUntil))
+	}
+	return s
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
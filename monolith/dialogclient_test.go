@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDialogService answers every attempt with the next status; 0 stands for a transport error
+type fakeDialogService struct {
+	statuses []int
+	calls    atomic.Int32
+	bodies   []string
+}
+
+func (f *fakeDialogService) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := int(f.calls.Add(1)) - 1
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		f.bodies = append(f.bodies, string(b))
+	}
+	status := f.statuses[len(f.statuses)-1]
+	if n < len(f.statuses) {
+		status = f.statuses[n]
+	}
+	if status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func newTestRetryTransport(base http.RoundTripper, threshold int, cooldown time.Duration) *retryTransport {
+	return &retryTransport{
+		base:        base,
+		breaker:     newCircuitBreaker(threshold, cooldown),
+		maxAttempts: 3,
+		backoff:     time.Millisecond,
+	}
+}
+
+func dialogRequest(method, body, idempotencyKey string) *http.Request {
+	req := httptest.NewRequest(method, "http://dialog-service/dialog/u2/send", nil)
+	if body != "" {
+		req = httptest.NewRequest(method, "http://dialog-service/dialog/u2/send", strings.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(body)), nil }
+	}
+	if idempotencyKey != "" {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+	return req
+}
+
+func TestRetryTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		req       func() *http.Request
+		statuses  []int
+		wantCalls int32
+		wantCode  int
+		wantErr   bool
+	}{
+		{"get succeeds", func() *http.Request { return dialogRequest(http.MethodGet, "", "") }, []int{200}, 1, 200, false},
+		{"get retried", func() *http.Request { return dialogRequest(http.MethodGet, "", "") }, []int{503, 0, 200}, 3, 200, false},
+		{"get gives up", func() *http.Request { return dialogRequest(http.MethodGet, "", "") }, []int{502}, 3, 502, false},
+		{"client error not retried", func() *http.Request { return dialogRequest(http.MethodGet, "", "") }, []int{404}, 1, 404, false},
+		{"post without key", func() *http.Request { return dialogRequest(http.MethodPost, `{"text":"hi"}`, "") }, []int{503, 200}, 1, 503, false},
+		{"post without key, transport error", func() *http.Request { return dialogRequest(http.MethodPost, `{"text":"hi"}`, "") }, []int{0, 200}, 1, 0, true},
+		{"post with key", func() *http.Request { return dialogRequest(http.MethodPost, `{"text":"hi"}`, "k1") }, []int{503, 200}, 2, 200, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeDialogService{statuses: tc.statuses}
+			resp, err := newTestRetryTransport(fake, 100, time.Minute).RoundTrip(tc.req())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && resp.StatusCode != tc.wantCode {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.wantCode)
+			}
+			if got := fake.calls.Load(); got != tc.wantCalls {
+				t.Fatalf("%d attempts, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryTransportReplaysBody(t *testing.T) {
+	fake := &fakeDialogService{statuses: []int{0, 200}}
+	if _, err := newTestRetryTransport(fake, 100, time.Minute).RoundTrip(dialogRequest(http.MethodPost, `{"text":"hi"}`, "k1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.bodies) != 2 || fake.bodies[0] != fake.bodies[1] || fake.bodies[1] != `{"text":"hi"}` {
+		t.Fatalf("attempts sent bodies %q", fake.bodies)
+	}
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	fake := &fakeDialogService{statuses: []int{0}}
+	rt := newTestRetryTransport(fake, 3, time.Minute)
+	rt.maxAttempts = 1
+
+	for i := 0; i < 3; i++ {
+		if _, err := rt.RoundTrip(dialogRequest(http.MethodGet, "", "")); err == nil {
+			t.Fatal("a transport error is not returned")
+		}
+	}
+	if s := rt.breaker.status(); s.State != breakerOpen || s.Failures != 3 {
+		t.Fatalf("breaker %+v after 3 failures, want open", s)
+	}
+
+	_, err := rt.RoundTrip(dialogRequest(http.MethodGet, "", ""))
+	var open *breakerOpenError
+	if !errors.As(err, &open) {
+		t.Fatalf("err = %v while open, want breakerOpenError", err)
+	}
+	if fake.calls.Load() != 3 {
+		t.Fatalf("a request reached the backend while the breaker was open")
+	}
+
+	// A success before the threshold resets the count
+	fake = &fakeDialogService{statuses: []int{0, 0, 200, 0, 0}}
+	rt = newTestRetryTransport(fake, 3, time.Minute)
+	rt.maxAttempts = 1
+	for i := 0; i < 5; i++ {
+		rt.RoundTrip(dialogRequest(http.MethodGet, "", ""))
+	}
+	if s := rt.breaker.status(); s.State != breakerClosed {
+		t.Fatalf("breaker %+v after non-consecutive failures, want closed", s)
+	}
+}
+
+func TestBreakerOpenProxyResponse(t *testing.T) {
+	fake := &fakeDialogService{statuses: []int{200}}
+	rt := newTestRetryTransport(fake, 1, 90*time.Second)
+	rt.breaker.record(true)
+
+	proxy := newDialogProxy()
+	proxy.Transport = rt
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dialogs", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d while open, want 503", w.Code)
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 89 || retryAfter > 90 {
+		t.Fatalf("Retry-After %q, want about 90", w.Header().Get("Retry-After"))
+	}
+	if fake.calls.Load() != 0 {
+		t.Fatal("the request reached the backend while the breaker was open")
+	}
+}
+
+// blockingDialogService holds every attempt until release is closed
+type blockingDialogService struct {
+	started chan struct{}
+	release chan struct{}
+	status  int
+	calls   atomic.Int32
+}
+
+func (b *blockingDialogService) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.calls.Add(1)
+	b.started <- struct{}{}
+	<-b.release
+	return &http.Response{StatusCode: b.status, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+}
+
+func TestBreakerHalfOpenSingleProbe(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		wantState breakerState
+	}{
+		{"probe succeeds", http.StatusOK, breakerClosed},
+		{"probe fails", http.StatusServiceUnavailable, breakerOpen},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &blockingDialogService{started: make(chan struct{}, 1), release: make(chan struct{}), status: tc.status}
+			rt := newTestRetryTransport(backend, 1, time.Minute)
+			rt.maxAttempts = 1
+			rt.breaker.record(true)
+			rt.breaker.openUntil = time.Now().Add(-time.Millisecond) // cooldown is over
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				resp, err := rt.RoundTrip(dialogRequest(http.MethodGet, "", ""))
+				if err == nil {
+					resp.Body.Close()
+				}
+			}()
+			<-backend.started
+
+			for i := 0; i < 3; i++ {
+				var open *breakerOpenError
+				if _, err := rt.RoundTrip(dialogRequest(http.MethodGet, "", "")); !errors.As(err, &open) {
+					t.Fatalf("err = %v during the probe, want breakerOpenError", err)
+				}
+			}
+			close(backend.release)
+			<-done
+
+			if backend.calls.Load() != 1 {
+				t.Fatalf("%d requests reached the backend in half-open, want 1", backend.calls.Load())
+			}
+			if s := rt.breaker.status(); s.State != tc.wantState {
+				t.Fatalf("breaker %s after the probe, want %s", s.State, tc.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"social-network-common/env"
+	"social-network-monolith/dialogpb"
+)
+
+// With DIALOG_TRANSPORT=grpc (default) sending, history, the dialog list and
+// message streams go to dialog-service over gRPC (dialog-service/proto/dialog.proto);
+// the JSON they return is the same as over HTTP. Each endpoint from
+// dialogbalancer.go is dialed on DIALOG_GRPC_PORT (9081), so endpoint choice,
+// health, the circuit breaker, retries and route timeouts (as gRPC deadlines)
+// work the same way. The caller's JWT and request ID travel as metadata.
+// Everything else, and all routes with DIALOG_TRANSPORT=http, is proxied over HTTP.
+var (
+	dialogGRPCEnabled = env.OrDefault("DIALOG_TRANSPORT", "grpc") == "grpc"
+	dialogGRPCPort    = env.OrDefault("DIALOG_GRPC_PORT", "9081")
+)
+
+var dialogGRPCRoutes = []struct {
+	method  string
+	pattern string // path.Match pattern
+	handler gin.HandlerFunc
+}{
+	{http.MethodPost, "/dialog/*/send", grpcSend},
+	{http.MethodPost, "/group/*/send", grpcSend},
+	{http.MethodGet, "/dialog/*/list", grpcList},
+	{http.MethodGet, "/group/*/list", grpcList},
+	{http.MethodGet, "/dialogs", grpcListDialogs},
+	{http.MethodGet, "/dialog/*/stream", grpcStream},
+	{http.MethodGet, "/group/*/stream", grpcStream},
+}
+
+func dialogGRPCHandler(method, urlPath string) gin.HandlerFunc {
+	if !dialogGRPCEnabled {
+		return nil
+	}
+	for _, route := range dialogGRPCRoutes {
+		if ok, _ := path.Match(route.pattern, urlPath); ok && route.method == method {
+			return route.handler
+		}
+	}
+	return nil
+}
+
+func (ep *dialogEndpoint) grpcClient() (dialogpb.DialogServiceClient, error) {
+	ep.grpcMu.Lock()
+	defer ep.grpcMu.Unlock()
+
+	if ep.grpcConn == nil {
+		conn, err := grpc.NewClient(net.JoinHostPort(ep.url.Hostname(), dialogGRPCPort),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, err
+		}
+		ep.grpcConn = conn
+	}
+	return dialogpb.NewDialogServiceClient(ep.grpcConn), nil
+}
+
+func (ep *dialogEndpoint) closeGRPC() {
+	ep.grpcMu.Lock()
+	defer ep.grpcMu.Unlock()
+	if ep.grpcConn != nil {
+		ep.grpcConn.Close()
+		ep.grpcConn = nil
+	}
+}
+
+// callDialog runs call against an endpoint picked for dialogKey, with the same
+// breaker and retry policy as retryTransport. All calls are safe to repeat:
+// reads are idempotent and sends carry a client_message_id.
+func callDialog(ctx context.Context, c *gin.Context, dialogKey string, call func(context.Context, dialogpb.DialogServiceClient) error) error {
+	return streamDialog(ctx, c, dialogKey, func(ctx context.Context, client dialogpb.DialogServiceClient, _ func()) error {
+		return call(ctx, client)
+	})
+}
+
+// streamDialog is callDialog for long-lived calls. The call reports progress
+// once the stream is established and after every delivered message: the first
+// report records a breaker success, which also frees a half-open probe slot
+// instead of holding it for the life of the stream, and every report resets
+// the retries, so only consecutive failed attempts count towards dialogMaxAttempts.
+func streamDialog(ctx context.Context, c *gin.Context, dialogKey string, call func(ctx context.Context, client dialogpb.DialogServiceClient, progress func()) error) error {
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		"authorization", c.GetHeader("Authorization"),
+		"x-request-id", c.GetString("requestId"))
+
+	for attempt := 1; ; attempt++ {
+		if wait, ok := dialogBreaker.allow(); !ok {
+			return &breakerOpenError{retryAfter: wait}
+		}
+
+		ep, err := dialogEndpoints.pick(dialogKey)
+		if err != nil {
+			dialogBreaker.record(true)
+			return err
+		}
+		client, err := ep.grpcClient()
+		if err != nil {
+			dialogBreaker.release()
+			return err
+		}
+
+		recorded := false
+		progress := func() {
+			if !recorded {
+				dialogBreaker.record(false)
+				recorded = true
+			}
+			attempt = 1
+		}
+		ep.inflight.Add(1)
+		err = call(ctx, client, progress)
+		ep.inflight.Add(-1)
+
+		if errors.Is(ctx.Err(), context.Canceled) {
+			if !recorded {
+				dialogBreaker.release()
+			}
+			return err
+		}
+		code := status.Code(err)
+		if failed := code == codes.Unavailable || code == codes.DeadlineExceeded; failed || !recorded {
+			dialogBreaker.record(failed)
+		}
+		if code != codes.Unavailable {
+			return err
+		}
+		dialogEndpoints.setHealth(ep, err)
+		if attempt >= dialogMaxAttempts {
+			return err
+		}
+
+		delay := time.Duration(rand.Int63n(int64(dialogRetryBase<<(attempt-1)) + 1))
+		log.Printf("Dialog service gRPC call %s attempt %d failed (%v), retrying in %s", c.Request.URL.Path, attempt, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// dialogConversation reads the conversation from /dialog/:user_id/... or /group/:group_id/...
+func dialogConversation(c *gin.Context) *dialogpb.Conversation {
+	parts := strings.Split(strings.Trim(c.Request.URL.Path, "/"), "/")
+	if parts[0] == "group" {
+		return &dialogpb.Conversation{Kind: &dialogpb.Conversation_GroupId{GroupId: parts[1]}}
+	}
+	return &dialogpb.Conversation{Kind: &dialogpb.Conversation_UserId{UserId: parts[1]}}
+}
+
+// dialogCallContext applies the route timeout, which gRPC passes on as the call deadline
+func dialogCallContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), dialogRouteTimeout(c.Request.Method, c.Request.URL.Path))
+}
+
+type dialogSendRequest struct {
+	Text            string `json:"text" binding:"required"`
+	ClientMessageID string `json:"client_message_id"`
+}
+
+func grpcSend(c *gin.Context) {
+	var req dialogSendRequest
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxDialogSendBody)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request data"})
+		return
+	}
+	// The key makes the retries in callDialog safe, same as makeSendReplayable does for HTTP
+	if req.ClientMessageID == "" {
+		req.ClientMessageID = c.GetHeader(idempotencyKeyHeader)
+	}
+	if req.ClientMessageID == "" {
+		req.ClientMessageID = uuid.New().String()
+	}
+
+	ctx, cancel := dialogCallContext(c)
+	defer cancel()
+
+	var resp *dialogpb.SendResponse
+	err := callDialog(ctx, c, dialogRoutingKey(c.GetString("userId"), c.Request.URL.Path),
+		func(ctx context.Context, client dialogpb.DialogServiceClient) (err error) {
+			resp, err = client.Send(ctx, &dialogpb.SendRequest{
+				Conversation:    dialogConversation(c),
+				Text:            req.Text,
+				ClientMessageId: req.ClientMessageID,
+			})
+			return err
+		})
+	if err != nil {
+		respondDialogError(c, err)
+		return
+	}
+
+	if resp.Replayed {
+		c.Header("Idempotent-Replayed", "true")
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Message sent successfully",
+		"id":        resp.Message.GetId(),
+		"timestamp": resp.Message.GetTimestamp().AsTime(),
+	})
+}
+
+func grpcList(c *gin.Context) {
+	limit, ok := queryLimit(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid before, after or limit"})
+		return
+	}
+
+	ctx, cancel := dialogCallContext(c)
+	defer cancel()
+
+	var resp *dialogpb.ListResponse
+	err := callDialog(ctx, c, dialogRoutingKey(c.GetString("userId"), c.Request.URL.Path),
+		func(ctx context.Context, client dialogpb.DialogServiceClient) (err error) {
+			resp, err = client.List(ctx, &dialogpb.ListRequest{
+				Conversation: dialogConversation(c),
+				Before:       c.Query("before"),
+				After:        c.Query("after"),
+				Limit:        limit,
+			})
+			return err
+		})
+	if err != nil {
+		respondDialogError(c, err)
+		return
+	}
+
+	messages := make([]DialogMessage, 0, len(resp.Messages))
+	for _, m := range resp.Messages {
+		messages = append(messages, fromProtoMessage(m))
+	}
+	c.JSON(http.StatusOK, messages)
+}
+
+// DialogSummary is a row of GET /dialogs, as dialog-service renders it
+type DialogSummary struct {
+	DialogKey       string    `json:"conversation_id"`
+	Kind            string    `json:"kind"`
+	PeerID          string    `json:"user_id,omitempty"`
+	Title           string    `json:"title,omitempty"`
+	LastMessageID   string    `json:"last_message_id"`
+	LastMessageFrom string    `json:"last_message_from"`
+	LastMessageText string    `json:"last_message_preview"`
+	LastMessageAt   time.Time `json:"last_message_at"`
+	Unread          int       `json:"unread"`
+}
+
+func grpcListDialogs(c *gin.Context) {
+	limit, ok := queryLimit(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid before or limit"})
+		return
+	}
+
+	ctx, cancel := dialogCallContext(c)
+	defer cancel()
+
+	var resp *dialogpb.ListDialogsResponse
+	err := callDialog(ctx, c, "", func(ctx context.Context, client dialogpb.DialogServiceClient) (err error) {
+		resp, err = client.ListDialogs(ctx, &dialogpb.ListDialogsRequest{Before: c.Query("before"), Limit: limit})
+		return err
+	})
+	if err != nil {
+		respondDialogError(c, err)
+		return
+	}
+
+	dialogs := make([]DialogSummary, 0, len(resp.Dialogs))
+	for _, d := range resp.Dialogs {
+		dialogs = append(dialogs, DialogSummary{
+			DialogKey:       d.ConversationId,
+			Kind:            d.Kind,
+			PeerID:          d.UserId,
+			Title:           d.Title,
+			LastMessageID:   d.LastMessageId,
+			LastMessageFrom: d.LastMessageFrom,
+			LastMessageText: d.LastMessagePreview,
+			LastMessageAt:   d.LastMessageAt.AsTime(),
+			Unread:          int(d.Unread),
+		})
+	}
+	c.JSON(http.StatusOK, dialogs)
+}
+
+// grpcStream upgrades to a WebSocket and pushes messages of the conversation
+// newer than ?after= (only new ones without it). A dropped gRPC stream is
+// resumed from the last delivered message by streamDialog's retries.
+func grpcStream(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	// The reader only notices the client going away
+	go func() {
+		defer cancel()
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			}
+		}
+	}()
+
+	req := &dialogpb.StreamRequest{Conversation: dialogConversation(c), After: c.Query("after")}
+	err = streamDialog(ctx, c, dialogRoutingKey(c.GetString("userId"), c.Request.URL.Path),
+		func(ctx context.Context, client dialogpb.DialogServiceClient, progress func()) error {
+			stream, err := client.Stream(ctx, req)
+			if err != nil {
+				return err
+			}
+			// dialog-service sends the headers as soon as the stream is set up
+			if _, err := stream.Header(); err != nil {
+				return err
+			}
+			progress()
+			for {
+				m, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				if err := conn.WriteJSON(fromProtoMessage(m)); err != nil {
+					cancel()
+					return err
+				}
+				req.After = m.Id
+				progress()
+			}
+		})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Dialog stream %s failed: %v", c.Request.URL.Path, err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, dialogErrorMessage(err)),
+			time.Now().Add(wsWriteTimeout))
+	}
+}
+
+func queryLimit(c *gin.Context) (int32, bool) {
+	limitStr := c.Query("limit")
+	if limitStr == "" {
+		return 0, true
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 32)
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	return int32(limit), true
+}
+
+func fromProtoMessage(m *dialogpb.Message) DialogMessage {
+	msg := DialogMessage{
+		ID:             m.Id,
+		ConversationID: m.ConversationId,
+		From:           m.From,
+		Text:           m.Text,
+		Timestamp:      m.Timestamp.AsTime(),
+		Edited:         m.Edited,
+	}
+	if m.EditedAt != nil {
+		editedAt := m.EditedAt.AsTime()
+		msg.EditedAt = &editedAt
+	}
+	return msg
+}
+
+// respondDialogError turns a gRPC status into the response dialog-service would give over HTTP
+func respondDialogError(c *gin.Context, err error) {
+	var open *breakerOpenError
+	switch {
+	case errors.As(err, &open):
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(open.retryAfter)))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Dialog service unavailable"})
+		return
+	case errors.Is(err, errNoDialogEndpoints):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Dialog service unavailable"})
+		return
+	}
+
+	httpStatus := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		httpStatus = http.StatusBadRequest
+	case codes.Unauthenticated:
+		httpStatus = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		httpStatus = http.StatusForbidden
+	case codes.NotFound:
+		httpStatus = http.StatusNotFound
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		httpStatus = http.StatusConflict
+	case codes.Unavailable:
+		httpStatus = http.StatusBadGateway
+	case codes.DeadlineExceeded:
+		httpStatus = http.StatusGatewayTimeout
+	}
+	if httpStatus >= http.StatusInternalServerError {
+		log.Printf("Dialog service gRPC call %s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
+	}
+	c.JSON(httpStatus, gin.H{"message": dialogErrorMessage(err)})
+}
+
+func dialogErrorMessage(err error) string {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return "Dialog service unavailable"
+	case codes.DeadlineExceeded:
+		return "Dialog service timed out"
+	}
+	if st, ok := status.FromError(err); ok {
+		return st.Message()
+	}
+	return "Dialog service unavailable"
+}
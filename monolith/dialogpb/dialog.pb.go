@@ -0,0 +1,825 @@
+// gRPC API Dialog Service. Сгенерированный код лежит в dialog-service/dialogpb
+// и monolith/dialogpb:
+//
+//   protoc -I dialog-service/proto \
+//     --go_out=dialog-service/dialogpb --go_opt=paths=source_relative \
+//     --go-grpc_out=dialog-service/dialogpb --go-grpc_opt=paths=source_relative \
+//     dialog.proto
+//
+// (то же для monolith/dialogpb с --go_opt=Mdialog.proto=social-network-monolith/dialogpb
+// и --go-grpc_opt=Mdialog.proto=social-network-monolith/dialogpb).
+//
+// Вызывающий передает в метаданных authorization ("Bearer <JWT>" монолита) и
+// x-request-id; беседа - личный диалог с user_id или группа group_id.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: dialog.proto
+
+package dialogpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Conversation struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Kind:
+	//
+	//	*Conversation_UserId
+	//	*Conversation_GroupId
+	Kind          isConversation_Kind `protobuf_oneof:"kind"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Conversation) Reset() {
+	*x = Conversation{}
+	mi := &file_dialog_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Conversation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Conversation) ProtoMessage() {}
+
+func (x *Conversation) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Conversation.ProtoReflect.Descriptor instead.
+func (*Conversation) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Conversation) GetKind() isConversation_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return nil
+}
+
+func (x *Conversation) GetUserId() string {
+	if x != nil {
+		if x, ok := x.Kind.(*Conversation_UserId); ok {
+			return x.UserId
+		}
+	}
+	return ""
+}
+
+func (x *Conversation) GetGroupId() string {
+	if x != nil {
+		if x, ok := x.Kind.(*Conversation_GroupId); ok {
+			return x.GroupId
+		}
+	}
+	return ""
+}
+
+type isConversation_Kind interface {
+	isConversation_Kind()
+}
+
+type Conversation_UserId struct {
+	UserId string `protobuf:"bytes,1,opt,name=user_id,json=userId,proto3,oneof"`
+}
+
+type Conversation_GroupId struct {
+	GroupId string `protobuf:"bytes,2,opt,name=group_id,json=groupId,proto3,oneof"`
+}
+
+func (*Conversation_UserId) isConversation_Kind() {}
+
+func (*Conversation_GroupId) isConversation_Kind() {}
+
+type Message struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Id             string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	ConversationId string                 `protobuf:"bytes,2,opt,name=conversation_id,json=conversationId,proto3" json:"conversation_id,omitempty"`
+	From           string                 `protobuf:"bytes,3,opt,name=from,proto3" json:"from,omitempty"`
+	Text           string                 `protobuf:"bytes,4,opt,name=text,proto3" json:"text,omitempty"`
+	Timestamp      *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Edited         bool                   `protobuf:"varint,6,opt,name=edited,proto3" json:"edited,omitempty"`
+	EditedAt       *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=edited_at,json=editedAt,proto3" json:"edited_at,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_dialog_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Message) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Message) GetConversationId() string {
+	if x != nil {
+		return x.ConversationId
+	}
+	return ""
+}
+
+func (x *Message) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *Message) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *Message) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Message) GetEdited() bool {
+	if x != nil {
+		return x.Edited
+	}
+	return false
+}
+
+func (x *Message) GetEditedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.EditedAt
+	}
+	return nil
+}
+
+type SendRequest struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Conversation    *Conversation          `protobuf:"bytes,1,opt,name=conversation,proto3" json:"conversation,omitempty"`
+	Text            string                 `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	ClientMessageId string                 `protobuf:"bytes,3,opt,name=client_message_id,json=clientMessageId,proto3" json:"client_message_id,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *SendRequest) Reset() {
+	*x = SendRequest{}
+	mi := &file_dialog_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SendRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SendRequest) ProtoMessage() {}
+
+func (x *SendRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SendRequest.ProtoReflect.Descriptor instead.
+func (*SendRequest) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SendRequest) GetConversation() *Conversation {
+	if x != nil {
+		return x.Conversation
+	}
+	return nil
+}
+
+func (x *SendRequest) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *SendRequest) GetClientMessageId() string {
+	if x != nil {
+		return x.ClientMessageId
+	}
+	return ""
+}
+
+type SendResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Message       *Message               `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	Replayed      bool                   `protobuf:"varint,2,opt,name=replayed,proto3" json:"replayed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SendResponse) Reset() {
+	*x = SendResponse{}
+	mi := &file_dialog_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SendResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SendResponse) ProtoMessage() {}
+
+func (x *SendResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SendResponse.ProtoReflect.Descriptor instead.
+func (*SendResponse) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SendResponse) GetMessage() *Message {
+	if x != nil {
+		return x.Message
+	}
+	return nil
+}
+
+func (x *SendResponse) GetReplayed() bool {
+	if x != nil {
+		return x.Replayed
+	}
+	return false
+}
+
+type ListRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Conversation  *Conversation          `protobuf:"bytes,1,opt,name=conversation,proto3" json:"conversation,omitempty"`
+	Before        string                 `protobuf:"bytes,2,opt,name=before,proto3" json:"before,omitempty"`
+	After         string                 `protobuf:"bytes,3,opt,name=after,proto3" json:"after,omitempty"`
+	Limit         int32                  `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListRequest) Reset() {
+	*x = ListRequest{}
+	mi := &file_dialog_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListRequest) ProtoMessage() {}
+
+func (x *ListRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListRequest.ProtoReflect.Descriptor instead.
+func (*ListRequest) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ListRequest) GetConversation() *Conversation {
+	if x != nil {
+		return x.Conversation
+	}
+	return nil
+}
+
+func (x *ListRequest) GetBefore() string {
+	if x != nil {
+		return x.Before
+	}
+	return ""
+}
+
+func (x *ListRequest) GetAfter() string {
+	if x != nil {
+		return x.After
+	}
+	return ""
+}
+
+func (x *ListRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type ListResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Messages      []*Message             `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListResponse) Reset() {
+	*x = ListResponse{}
+	mi := &file_dialog_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListResponse) ProtoMessage() {}
+
+func (x *ListResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListResponse.ProtoReflect.Descriptor instead.
+func (*ListResponse) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ListResponse) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+type ListDialogsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Before        string                 `protobuf:"bytes,1,opt,name=before,proto3" json:"before,omitempty"`
+	Limit         int32                  `protobuf:"varint,2,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListDialogsRequest) Reset() {
+	*x = ListDialogsRequest{}
+	mi := &file_dialog_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListDialogsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListDialogsRequest) ProtoMessage() {}
+
+func (x *ListDialogsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListDialogsRequest.ProtoReflect.Descriptor instead.
+func (*ListDialogsRequest) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ListDialogsRequest) GetBefore() string {
+	if x != nil {
+		return x.Before
+	}
+	return ""
+}
+
+func (x *ListDialogsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type DialogSummary struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	ConversationId     string                 `protobuf:"bytes,1,opt,name=conversation_id,json=conversationId,proto3" json:"conversation_id,omitempty"`
+	Kind               string                 `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	UserId             string                 `protobuf:"bytes,3,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	Title              string                 `protobuf:"bytes,4,opt,name=title,proto3" json:"title,omitempty"`
+	LastMessageId      string                 `protobuf:"bytes,5,opt,name=last_message_id,json=lastMessageId,proto3" json:"last_message_id,omitempty"`
+	LastMessageFrom    string                 `protobuf:"bytes,6,opt,name=last_message_from,json=lastMessageFrom,proto3" json:"last_message_from,omitempty"`
+	LastMessagePreview string                 `protobuf:"bytes,7,opt,name=last_message_preview,json=lastMessagePreview,proto3" json:"last_message_preview,omitempty"`
+	LastMessageAt      *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=last_message_at,json=lastMessageAt,proto3" json:"last_message_at,omitempty"`
+	Unread             int32                  `protobuf:"varint,9,opt,name=unread,proto3" json:"unread,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *DialogSummary) Reset() {
+	*x = DialogSummary{}
+	mi := &file_dialog_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DialogSummary) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DialogSummary) ProtoMessage() {}
+
+func (x *DialogSummary) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DialogSummary.ProtoReflect.Descriptor instead.
+func (*DialogSummary) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *DialogSummary) GetConversationId() string {
+	if x != nil {
+		return x.ConversationId
+	}
+	return ""
+}
+
+func (x *DialogSummary) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *DialogSummary) GetUserId() string {
+	if x != nil {
+		return x.UserId
+	}
+	return ""
+}
+
+func (x *DialogSummary) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *DialogSummary) GetLastMessageId() string {
+	if x != nil {
+		return x.LastMessageId
+	}
+	return ""
+}
+
+func (x *DialogSummary) GetLastMessageFrom() string {
+	if x != nil {
+		return x.LastMessageFrom
+	}
+	return ""
+}
+
+func (x *DialogSummary) GetLastMessagePreview() string {
+	if x != nil {
+		return x.LastMessagePreview
+	}
+	return ""
+}
+
+func (x *DialogSummary) GetLastMessageAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastMessageAt
+	}
+	return nil
+}
+
+func (x *DialogSummary) GetUnread() int32 {
+	if x != nil {
+		return x.Unread
+	}
+	return 0
+}
+
+type ListDialogsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Dialogs       []*DialogSummary       `protobuf:"bytes,1,rep,name=dialogs,proto3" json:"dialogs,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListDialogsResponse) Reset() {
+	*x = ListDialogsResponse{}
+	mi := &file_dialog_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListDialogsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListDialogsResponse) ProtoMessage() {}
+
+func (x *ListDialogsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListDialogsResponse.ProtoReflect.Descriptor instead.
+func (*ListDialogsResponse) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ListDialogsResponse) GetDialogs() []*DialogSummary {
+	if x != nil {
+		return x.Dialogs
+	}
+	return nil
+}
+
+type StreamRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Conversation  *Conversation          `protobuf:"bytes,1,opt,name=conversation,proto3" json:"conversation,omitempty"`
+	After         string                 `protobuf:"bytes,2,opt,name=after,proto3" json:"after,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamRequest) Reset() {
+	*x = StreamRequest{}
+	mi := &file_dialog_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamRequest) ProtoMessage() {}
+
+func (x *StreamRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dialog_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamRequest.ProtoReflect.Descriptor instead.
+func (*StreamRequest) Descriptor() ([]byte, []int) {
+	return file_dialog_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *StreamRequest) GetConversation() *Conversation {
+	if x != nil {
+		return x.Conversation
+	}
+	return nil
+}
+
+func (x *StreamRequest) GetAfter() string {
+	if x != nil {
+		return x.After
+	}
+	return ""
+}
+
+var File_dialog_proto protoreflect.FileDescriptor
+
+const file_dialog_proto_rawDesc = "" +
+	"\n" +
+	"\fdialog.proto\x12\tdialog.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"N\n" +
+	"\fConversation\x12\x19\n" +
+	"\auser_id\x18\x01 \x01(\tH\x00R\x06userId\x12\x1b\n" +
+	"\bgroup_id\x18\x02 \x01(\tH\x00R\agroupIdB\x06\n" +
+	"\x04kind\"\xf5\x01\n" +
+	"\aMessage\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12'\n" +
+	"\x0fconversation_id\x18\x02 \x01(\tR\x0econversationId\x12\x12\n" +
+	"\x04from\x18\x03 \x01(\tR\x04from\x12\x12\n" +
+	"\x04text\x18\x04 \x01(\tR\x04text\x128\n" +
+	"\ttimestamp\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12\x16\n" +
+	"\x06edited\x18\x06 \x01(\bR\x06edited\x127\n" +
+	"\tedited_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\beditedAt\"\x8a\x01\n" +
+	"\vSendRequest\x12;\n" +
+	"\fconversation\x18\x01 \x01(\v2\x17.dialog.v1.ConversationR\fconversation\x12\x12\n" +
+	"\x04text\x18\x02 \x01(\tR\x04text\x12*\n" +
+	"\x11client_message_id\x18\x03 \x01(\tR\x0fclientMessageId\"X\n" +
+	"\fSendResponse\x12,\n" +
+	"\amessage\x18\x01 \x01(\v2\x12.dialog.v1.MessageR\amessage\x12\x1a\n" +
+	"\breplayed\x18\x02 \x01(\bR\breplayed\"\x8e\x01\n" +
+	"\vListRequest\x12;\n" +
+	"\fconversation\x18\x01 \x01(\v2\x17.dialog.v1.ConversationR\fconversation\x12\x16\n" +
+	"\x06before\x18\x02 \x01(\tR\x06before\x12\x14\n" +
+	"\x05after\x18\x03 \x01(\tR\x05after\x12\x14\n" +
+	"\x05limit\x18\x04 \x01(\x05R\x05limit\">\n" +
+	"\fListResponse\x12.\n" +
+	"\bmessages\x18\x01 \x03(\v2\x12.dialog.v1.MessageR\bmessages\"B\n" +
+	"\x12ListDialogsRequest\x12\x16\n" +
+	"\x06before\x18\x01 \x01(\tR\x06before\x12\x14\n" +
+	"\x05limit\x18\x02 \x01(\x05R\x05limit\"\xdd\x02\n" +
+	"\rDialogSummary\x12'\n" +
+	"\x0fconversation_id\x18\x01 \x01(\tR\x0econversationId\x12\x12\n" +
+	"\x04kind\x18\x02 \x01(\tR\x04kind\x12\x17\n" +
+	"\auser_id\x18\x03 \x01(\tR\x06userId\x12\x14\n" +
+	"\x05title\x18\x04 \x01(\tR\x05title\x12&\n" +
+	"\x0flast_message_id\x18\x05 \x01(\tR\rlastMessageId\x12*\n" +
+	"\x11last_message_from\x18\x06 \x01(\tR\x0flastMessageFrom\x120\n" +
+	"\x14last_message_preview\x18\a \x01(\tR\x12lastMessagePreview\x12B\n" +
+	"\x0flast_message_at\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\rlastMessageAt\x12\x16\n" +
+	"\x06unread\x18\t \x01(\x05R\x06unread\"I\n" +
+	"\x13ListDialogsResponse\x122\n" +
+	"\adialogs\x18\x01 \x03(\v2\x18.dialog.v1.DialogSummaryR\adialogs\"b\n" +
+	"\rStreamRequest\x12;\n" +
+	"\fconversation\x18\x01 \x01(\v2\x17.dialog.v1.ConversationR\fconversation\x12\x14\n" +
+	"\x05after\x18\x02 \x01(\tR\x05after2\x89\x02\n" +
+	"\rDialogService\x127\n" +
+	"\x04Send\x12\x16.dialog.v1.SendRequest\x1a\x17.dialog.v1.SendResponse\x127\n" +
+	"\x04List\x12\x16.dialog.v1.ListRequest\x1a\x17.dialog.v1.ListResponse\x12L\n" +
+	"\vListDialogs\x12\x1d.dialog.v1.ListDialogsRequest\x1a\x1e.dialog.v1.ListDialogsResponse\x128\n" +
+	"\x06Stream\x12\x18.dialog.v1.StreamRequest\x1a\x12.dialog.v1.Message0\x01B\x19Z\x17dialog-service/dialogpbb\x06proto3"
+
+var (
+	file_dialog_proto_rawDescOnce sync.Once
+	file_dialog_proto_rawDescData []byte
+)
+
+func file_dialog_proto_rawDescGZIP() []byte {
+	file_dialog_proto_rawDescOnce.Do(func() {
+		file_dialog_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_dialog_proto_rawDesc), len(file_dialog_proto_rawDesc)))
+	})
+	return file_dialog_proto_rawDescData
+}
+
+var file_dialog_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_dialog_proto_goTypes = []any{
+	(*Conversation)(nil),          // 0: dialog.v1.Conversation
+	(*Message)(nil),               // 1: dialog.v1.Message
+	(*SendRequest)(nil),           // 2: dialog.v1.SendRequest
+	(*SendResponse)(nil),          // 3: dialog.v1.SendResponse
+	(*ListRequest)(nil),           // 4: dialog.v1.ListRequest
+	(*ListResponse)(nil),          // 5: dialog.v1.ListResponse
+	(*ListDialogsRequest)(nil),    // 6: dialog.v1.ListDialogsRequest
+	(*DialogSummary)(nil),         // 7: dialog.v1.DialogSummary
+	(*ListDialogsResponse)(nil),   // 8: dialog.v1.ListDialogsResponse
+	(*StreamRequest)(nil),         // 9: dialog.v1.StreamRequest
+	(*timestamppb.Timestamp)(nil), // 10: google.protobuf.Timestamp
+}
+var file_dialog_proto_depIdxs = []int32{
+	10, // 0: dialog.v1.Message.timestamp:type_name -> google.protobuf.Timestamp
+	10, // 1: dialog.v1.Message.edited_at:type_name -> google.protobuf.Timestamp
+	0,  // 2: dialog.v1.SendRequest.conversation:type_name -> dialog.v1.Conversation
+	1,  // 3: dialog.v1.SendResponse.message:type_name -> dialog.v1.Message
+	0,  // 4: dialog.v1.ListRequest.conversation:type_name -> dialog.v1.Conversation
+	1,  // 5: dialog.v1.ListResponse.messages:type_name -> dialog.v1.Message
+	10, // 6: dialog.v1.DialogSummary.last_message_at:type_name -> google.protobuf.Timestamp
+	7,  // 7: dialog.v1.ListDialogsResponse.dialogs:type_name -> dialog.v1.DialogSummary
+	0,  // 8: dialog.v1.StreamRequest.conversation:type_name -> dialog.v1.Conversation
+	2,  // 9: dialog.v1.DialogService.Send:input_type -> dialog.v1.SendRequest
+	4,  // 10: dialog.v1.DialogService.List:input_type -> dialog.v1.ListRequest
+	6,  // 11: dialog.v1.DialogService.ListDialogs:input_type -> dialog.v1.ListDialogsRequest
+	9,  // 12: dialog.v1.DialogService.Stream:input_type -> dialog.v1.StreamRequest
+	3,  // 13: dialog.v1.DialogService.Send:output_type -> dialog.v1.SendResponse
+	5,  // 14: dialog.v1.DialogService.List:output_type -> dialog.v1.ListResponse
+	8,  // 15: dialog.v1.DialogService.ListDialogs:output_type -> dialog.v1.ListDialogsResponse
+	1,  // 16: dialog.v1.DialogService.Stream:output_type -> dialog.v1.Message
+	13, // [13:17] is the sub-list for method output_type
+	9,  // [9:13] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_dialog_proto_init() }
+func file_dialog_proto_init() {
+	if File_dialog_proto != nil {
+		return
+	}
+	file_dialog_proto_msgTypes[0].OneofWrappers = []any{
+		(*Conversation_UserId)(nil),
+		(*Conversation_GroupId)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_dialog_proto_rawDesc), len(file_dialog_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_dialog_proto_goTypes,
+		DependencyIndexes: file_dialog_proto_depIdxs,
+		MessageInfos:      file_dialog_proto_msgTypes,
+	}.Build()
+	File_dialog_proto = out.File
+	file_dialog_proto_goTypes = nil
+	file_dialog_proto_depIdxs = nil
+}
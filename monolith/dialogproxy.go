@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Dialogs live in dialog-service. The monolith forwards every request under
+// dialogPrefixes as is: the body is streamed both ways and status codes and
+// headers come back unchanged. Only the bearer JWT is replaced with a
+// short-lived one for the same session (see dialogTokens), which dialog-service
+// verifies on its own. A new dialog-service endpoint under one of the prefixes
+// needs no monolith code.
+var dialogPrefixes = []string{"/dialog", "/dialogs", "/group", "/groups"}
+
+const (
+	requestIDHeader      = "X-Request-ID"
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// dialogUpstream is a placeholder, balancedTransport puts the chosen endpoint in its place
+var dialogUpstream = &url.URL{Scheme: "http", Host: "dialog-service"}
+
+var dialogProxy = newDialogProxy()
+
+func newDialogProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport: dialogTransport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(dialogUpstream)
+			r.SetXForwarded()
+			// Rewrite strips hop-by-hop headers but keeps the rest, the request ID included
+			r.Out.Header.Set(requestIDHeader, r.In.Header.Get(requestIDHeader))
+		},
+		// Flush right away so long-running responses are not held in the proxy buffer
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			// requestID has already set it on the monolith's response
+			resp.Header.Del(requestIDHeader)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status, message := http.StatusBadGateway, "Dialog service unavailable"
+			var open *breakerOpenError
+			switch {
+			case errors.As(err, &open):
+				status = http.StatusServiceUnavailable
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(open.retryAfter)))
+			case errors.Is(err, errNoDialogEndpoints):
+				status = http.StatusServiceUnavailable
+				log.Printf("Dialog service request %s %s failed: %v", r.Method, r.URL.Path, err)
+			case errors.Is(err, context.DeadlineExceeded):
+				status, message = http.StatusGatewayTimeout, "Dialog service timed out"
+				log.Printf("Dialog service request %s %s timed out", r.Method, r.URL.Path)
+			default:
+				log.Printf("Dialog service request %s %s failed: %v", r.Method, r.URL.Path, err)
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(gin.H{"message": message})
+		},
+	}
+}
+
+func proxyToDialogService(c *gin.Context) {
+	if !checkDialogUsers(c) {
+		return
+	}
+	token, err := dialogTokens.get(c.GetString("userId"), c.GetString("sessionId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to issue token"})
+		return
+	}
+	c.Request.Header.Set("Authorization", "Bearer "+token)
+	if handler := dialogGRPCHandler(c.Request.Method, c.Request.URL.Path); handler != nil {
+		handler(c)
+		return
+	}
+	if isDialogSend(c.Request) && !makeSendReplayable(c) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), dialogRouteTimeout(c.Request.Method, c.Request.URL.Path))
+	defer cancel()
+	ctx = withDialogKey(ctx, dialogRoutingKey(c.GetString("userId"), c.Request.URL.Path))
+	dialogProxy.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+}
+
+// checkDialogUsers: users are owned by the monolith, so before a message goes
+// to a direct dialog we make sure the recipient exists, and the same for the
+// members of a new group (POST /groups) and a member added to one (POST
+// /group/:id/members). A user who is not on the replica yet (registered a
+// moment ago by someone else, whose write position the caller does not know)
+// is looked up on the master. A body that does not parse is left to
+// dialog-service to reject.
+func checkDialogUsers(c *gin.Context) bool {
+	if c.Request.Method != http.MethodPost {
+		return true
+	}
+	parts := strings.Split(strings.Trim(c.Request.URL.Path, "/"), "/")
+	var userIds []string
+	notFound := "User not found"
+	switch {
+	case len(parts) == 3 && parts[0] == "dialog" && parts[2] == "send":
+		userIds, notFound = []string{parts[1]}, "Recipient not found"
+	case len(parts) == 1 && parts[0] == "groups":
+		body, ok := bufferBody(c, maxDialogGroupBody, "Request is too large")
+		if !ok {
+			return false
+		}
+		var req struct {
+			Members []string `json:"members"`
+		}
+		if json.Unmarshal(body, &req) != nil {
+			return true
+		}
+		userIds = req.Members
+	case len(parts) == 3 && parts[0] == "group" && parts[2] == "members":
+		body, ok := bufferBody(c, maxDialogGroupBody, "Request is too large")
+		if !ok {
+			return false
+		}
+		var req struct {
+			UserID string `json:"user_id"`
+		}
+		if json.Unmarshal(body, &req) != nil || req.UserID == "" {
+			return true
+		}
+		userIds = []string{req.UserID}
+	default:
+		return true
+	}
+
+	missing, err := missingUsers(c.Request.Context(), userIds)
+	if err != nil {
+		log.Printf("Failed to look up users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to look up users"})
+		return false
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": notFound, "user_ids": missing})
+		return false
+	}
+	return true
+}
+
+// missingUsers returns the IDs that are not registered: the ones not found on
+// the replica are looked up on the master
+func missingUsers(ctx context.Context, userIds []string) ([]string, error) {
+	seen := make(map[string]bool, len(userIds))
+	var missing, valid []string
+	for _, id := range userIds {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if uuid.Validate(id) != nil {
+			missing = append(missing, id)
+		} else {
+			valid = append(valid, id)
+		}
+	}
+	for _, db := range []rowsQuerier{slaveDB, masterDB} {
+		if len(valid) == 0 {
+			break
+		}
+		rows, err := db.Query(ctx, "SELECT id::text FROM users WHERE id = ANY($1::uuid[])", valid)
+		if err != nil {
+			return nil, err
+		}
+		found, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return nil, err
+		}
+		exists := make(map[string]bool, len(found))
+		for _, id := range found {
+			exists[id] = true
+		}
+		valid = slices.DeleteFunc(valid, func(id string) bool { return exists[id] })
+	}
+	return append(missing, valid...), nil
+}
+
+const (
+	// maxDialogSendBody limits a send request buffered for retries
+	maxDialogSendBody = 64 << 10
+	// maxDialogGroupBody limits a group request read for checkDialogUsers,
+	// enough for a group of 1000 members
+	maxDialogGroupBody = 64 << 10
+)
+
+func isDialogSend(r *http.Request) bool {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	return r.Method == http.MethodPost && len(parts) == 3 &&
+		(parts[0] == "dialog" || parts[0] == "group") && parts[2] == "send"
+}
+
+// makeSendReplayable lets retryTransport repeat a send: the request gets an
+// Idempotency-Key unless the client sent one (a client_message_id in the body
+// takes precedence in dialog-service anyway), so dialog-service stores the
+// message once, and the body is buffered to be sent again
+func makeSendReplayable(c *gin.Context) bool {
+	if c.GetHeader(idempotencyKeyHeader) == "" {
+		c.Request.Header.Set(idempotencyKeyHeader, uuid.New().String())
+	}
+
+	_, ok := bufferBody(c, maxDialogSendBody, "Message is too large")
+	return ok
+}
+
+// bufferBody reads up to limit bytes of the request body and puts them back,
+// so the body can be forwarded and replayed
+func bufferBody(c *gin.Context, limit int64, tooLargeMessage string) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": tooLargeMessage})
+		return nil, false
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to read the request body"})
+		return nil, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	c.Request.ContentLength = int64(len(body))
+	return body, true
+}
+
+// requestID tags every request with X-Request-ID, keeping the caller's one if
+// it was sent, and returns it in the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+			c.Request.Header.Set(requestIDHeader, id)
+		}
+		c.Header(requestIDHeader, id)
+		c.Set("requestId", id)
+		c.Next()
+	}
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"social-network-common/env"
+)
+
+// Materialized feeds: for every active reader the cache keeps the newest
+// feedSize post entries of their friends. createPost pushes new entries into
+// the followers' cached feeds (fan-out on write) in background workers and
+// deletePost takes them out the same way; a cache miss or a friendship change
+// rebuilds the feed from the DB. Other instances learn about posts, deletions
+// and friendship changes from the notifications on postsChannel (realtime.go).
+//
+// Authors with more than feedCelebrityThreshold followers are not fanned out:
+// their posts are pulled and merged into the feed on read instead.
+//
+// Configuration:
+//
+//	FEED_CACHE                memory (default) or none
+//	FEED_CACHE_SIZE           entries per feed (1000)
+//	FEED_CACHE_USERS          feeds kept in memory, LRU (10000)
+//	FEED_CACHE_TTL            feed lifetime, bounds staleness between instances (5m)
+//	FEED_CELEBRITY_THRESHOLD  followers after which fan-out is skipped (10000)
+//	FEED_FANOUT_WORKERS       fan-out goroutines (4)
+//	FEED_FANOUT_QUEUE         pending fan-out jobs before new ones are dropped (1024)
+var (
+	feedSize               = envInt("FEED_CACHE_SIZE", 1000)
+	feedCelebrityThreshold = envInt("FEED_CELEBRITY_THRESHOLD", 10000)
+)
+
+// feedCache is nil when caching is disabled; getFeed then reads straight from the DB
+var feedCache FeedCache
+
+var feedFanout *fanout
+
+type feedEntry struct {
+	PostID    string
+	AuthorID  string
+	CreatedAt time.Time
+}
+
+func (e feedEntry) before(other feedEntry) bool {
+	if e.CreatedAt.Equal(other.CreatedAt) {
+		return e.PostID > other.PostID
+	}
+	return e.CreatedAt.After(other.CreatedAt)
+}
+
+type cachedFeed struct {
+	Entries     []feedEntry // newest first, at most feedSize
+	Celebrities []string    // friends whose posts are merged on read
+}
+
+// FeedCache is the storage for materialized feeds. Implementations must be safe
+// for concurrent use and must not share Entries slices with callers.
+type FeedCache interface {
+	Get(userId string) (*cachedFeed, bool)
+	Set(userId string, feed *cachedFeed)
+	// Push adds an entry to the feed if it is cached; missing feeds are left to be rebuilt on read
+	Push(userId string, entry feedEntry)
+	// Remove takes an entry out of the feed if it is cached
+	Remove(userId string, entry feedEntry)
+	Invalidate(userId string)
+	Len() int
+}
+
+func initFeed() {
+	switch mode := env.OrDefault("FEED_CACHE", "memory"); mode {
+	case "none":
+		log.Printf("Feed cache disabled")
+		return
+	case "memory":
+		feedCache = newMemoryFeedCache(
+			envInt("FEED_CACHE_USERS", 10000),
+			envDuration("FEED_CACHE_TTL", 5*time.Minute),
+		)
+	default:
+		log.Fatalf("Unknown FEED_CACHE %q", mode)
+	}
+	feedFanout = newFanout(feedCache, envInt("FEED_FANOUT_WORKERS", 4), envInt("FEED_FANOUT_QUEUE", 1024))
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s=%q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// memoryFeedCache is an in-process LRU of feeds with a TTL
+type memoryFeedCache struct {
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	lru      *list.List // front = most recently used
+	maxUsers int
+	ttl      time.Duration
+}
+
+type memoryFeedItem struct {
+	userId  string
+	feed    *cachedFeed
+	builtAt time.Time
+}
+
+func newMemoryFeedCache(maxUsers int, ttl time.Duration) *memoryFeedCache {
+	return &memoryFeedCache{
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+		maxUsers: maxUsers,
+		ttl:      ttl,
+	}
+}
+
+func (m *memoryFeedCache) Get(userId string) (*cachedFeed, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[userId]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*memoryFeedItem)
+	if time.Since(item.builtAt) > m.ttl {
+		m.lru.Remove(el)
+		delete(m.items, userId)
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return &cachedFeed{
+		Entries:     append([]feedEntry(nil), item.feed.Entries...),
+		Celebrities: item.feed.Celebrities,
+	}, true
+}
+
+func (m *memoryFeedCache) Set(userId string, feed *cachedFeed) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item := &memoryFeedItem{userId: userId, feed: feed, builtAt: time.Now()}
+	if el, ok := m.items[userId]; ok {
+		el.Value = item
+		m.lru.MoveToFront(el)
+		return
+	}
+	m.items[userId] = m.lru.PushFront(item)
+	for m.lru.Len() > m.maxUsers {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.items, oldest.Value.(*memoryFeedItem).userId)
+	}
+}
+
+func (m *memoryFeedCache) Push(userId string, entry feedEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[userId]
+	if !ok {
+		return
+	}
+	item := el.Value.(*memoryFeedItem)
+	old := item.feed.Entries
+	pos := sort.Search(len(old), func(i int) bool { return entry.before(old[i]) })
+	if pos == len(old) && len(old) >= feedSize {
+		return
+	}
+	if pos > 0 && old[pos-1].PostID == entry.PostID {
+		return // already in the feed
+	}
+
+	// Copy on write: readers got their own copies in Get, but keep the stored slice immutable anyway
+	entries := make([]feedEntry, 0, len(old)+1)
+	entries = append(entries, old[:pos]...)
+	entries = append(entries, entry)
+	entries = append(entries, old[pos:]...)
+	if len(entries) > feedSize {
+		entries = entries[:feedSize]
+	}
+	item.feed = &cachedFeed{Entries: entries, Celebrities: item.feed.Celebrities}
+}
+
+func (m *memoryFeedCache) Remove(userId string, entry feedEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[userId]
+	if !ok {
+		return
+	}
+	item := el.Value.(*memoryFeedItem)
+	old := item.feed.Entries
+	pos := sort.Search(len(old), func(i int) bool { return entry.before(old[i]) })
+	if pos == 0 || old[pos-1].PostID != entry.PostID {
+		return
+	}
+
+	entries := make([]feedEntry, 0, len(old)-1)
+	entries = append(entries, old[:pos-1]...)
+	entries = append(entries, old[pos:]...)
+	item.feed = &cachedFeed{Entries: entries, Celebrities: item.feed.Celebrities}
+}
+
+func (m *memoryFeedCache) Invalidate(userId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.items[userId]; ok {
+		m.lru.Remove(el)
+		delete(m.items, userId)
+	}
+}
+
+func (m *memoryFeedCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// fanout pushes new posts into followers' cached feeds, and takes deleted ones
+// out, off the request path. When the queue is full the job is dropped: the
+// affected feeds catch up after FEED_CACHE_TTL.
+type fanout struct {
+	cache FeedCache
+	jobs  chan fanoutJob
+}
+
+type fanoutJob struct {
+	entry  feedEntry
+	remove bool
+}
+
+func newFanout(cache FeedCache, workers, queue int) *fanout {
+	f := &fanout{cache: cache, jobs: make(chan fanoutJob, queue)}
+	for i := 0; i < workers; i++ {
+		go f.worker()
+	}
+	return f
+}
+
+func (f *fanout) Publish(entry feedEntry) {
+	f.enqueue(fanoutJob{entry: entry})
+}
+
+func (f *fanout) Retract(entry feedEntry) {
+	f.enqueue(fanoutJob{entry: entry, remove: true})
+}
+
+func (f *fanout) enqueue(job fanoutJob) {
+	select {
+	case f.jobs <- job:
+	default:
+		log.Printf("Feed fan-out queue is full, dropping post %s", job.entry.PostID)
+	}
+}
+
+func (f *fanout) worker() {
+	for job := range f.jobs {
+		if err := f.deliver(context.Background(), job); err != nil {
+			log.Printf("Feed fan-out for post %s failed: %v", job.entry.PostID, err)
+		}
+	}
+}
+
+func (f *fanout) deliver(ctx context.Context, job fanoutJob) error {
+	entry := job.entry
+	celebrity, err := isCelebrity(ctx, entry.AuthorID)
+	if err != nil {
+		return err
+	}
+	if celebrity {
+		// Readers pull celebrity posts on read, see celebrityPosts
+		return nil
+	}
+
+	const batchSize = 1000
+	after := "00000000-0000-0000-0000-000000000000"
+	for {
+		followers, err := queryStrings(ctx,
+			`SELECT user_id::text FROM friends
+			 WHERE friend_id = $1::uuid AND user_id > $2::uuid
+			 ORDER BY user_id LIMIT $3`,
+			entry.AuthorID, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, followerId := range followers {
+			if job.remove {
+				f.cache.Remove(followerId, entry)
+			} else {
+				f.cache.Push(followerId, entry)
+			}
+		}
+		if len(followers) < batchSize {
+			return nil
+		}
+		after = followers[len(followers)-1]
+	}
+}
+
+// isCelebrity counts at most feedCelebrityThreshold+1 followers, so the check stays cheap for huge accounts
+func isCelebrity(ctx context.Context, authorId string) (bool, error) {
+	var followers int
+	err := slaveDB.QueryRow(ctx,
+		`SELECT count(*) FROM (SELECT 1 FROM friends WHERE friend_id = $1::uuid LIMIT $2) f`,
+		authorId, feedCelebrityThreshold+1).Scan(&followers)
+	if err != nil {
+		return false, err
+	}
+	return followers > feedCelebrityThreshold, nil
+}
+
+func queryStrings(ctx context.Context, sql string, args ...any) ([]string, error) {
+	rows, err := slaveDB.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func invalidateFeed(userId string) {
+	if feedCache != nil {
+		feedCache.Invalidate(userId)
+	}
+}
+
+func publishToFeeds(entry feedEntry) {
+	if feedFanout != nil {
+		feedFanout.Publish(entry)
+	}
+}
+
+func retractFromFeeds(entry feedEntry) {
+	if feedFanout != nil {
+		feedFanout.Retract(entry)
+	}
+}
+
+// friendsChanged drops the user's feed on every instance after a friendship change
+func friendsChanged(ctx context.Context, userId string) {
+	if feedCache == nil {
+		return
+	}
+	feedCache.Invalidate(userId)
+	notifyPosts(ctx, postNotification{Event: postEventInvalidated, UserID: userId})
+}
+
+// postDeleted takes the post out of the followers' feeds on every instance
+func postDeleted(ctx context.Context, entry feedEntry) {
+	if feedCache == nil {
+		return
+	}
+	retractFromFeeds(entry)
+	notifyPosts(ctx, postNotification{
+		Event:        postEventDeleted,
+		PostID:       entry.PostID,
+		AuthorUserID: entry.AuthorID,
+		CreatedAt:    entry.CreatedAt,
+	})
+}
+
+// buildFeed materializes the reader's feed from the DB
+func buildFeed(ctx context.Context, userId string) (*cachedFeed, error) {
+	celebrities, err := queryStrings(ctx,
+		`SELECT f.friend_id::text FROM friends f
+		 WHERE f.user_id = $1::uuid
+		 AND (SELECT count(*) FROM (SELECT 1 FROM friends x WHERE x.friend_id = f.friend_id LIMIT $2) t) > $3`,
+		userId, feedCelebrityThreshold+1, feedCelebrityThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := slaveDB.Query(ctx,
+		`SELECT id::text, author_user_id::text, created_at FROM posts
+		 WHERE author_user_id IN (SELECT friend_id FROM friends WHERE user_id = $1::uuid)
+		 ORDER BY created_at DESC, id DESC LIMIT $2`,
+		userId, feedSize)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := collectFeedEntries(rows)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedFeed{Entries: entries, Celebrities: celebrities}, nil
+}
+
+// celebrityPosts merges the newest posts of celebrity friends into the cached entries
+func celebrityPosts(ctx context.Context, feed *cachedFeed) ([]feedEntry, error) {
+	if len(feed.Celebrities) == 0 {
+		return feed.Entries, nil
+	}
+
+	rows, err := slaveDB.Query(ctx,
+		`SELECT id::text, author_user_id::text, created_at FROM posts
+		 WHERE author_user_id = ANY($1::text[]::uuid[])
+		 ORDER BY created_at DESC, id DESC LIMIT $2`,
+		feed.Celebrities, feedSize)
+	if err != nil {
+		return nil, err
+	}
+	pulled, err := collectFeedEntries(rows)
+	if err != nil {
+		return nil, err
+	}
+	return mergeFeedEntries(feed.Entries, pulled), nil
+}
+
+// mergeFeedEntries combines pushed and pulled entries newest first, without
+// duplicates, keeping at most feedSize of them
+func mergeFeedEntries(cached, pulled []feedEntry) []feedEntry {
+	merged := make([]feedEntry, 0, len(cached)+len(pulled))
+	seen := make(map[string]bool, len(cached)+len(pulled))
+	for _, batch := range [][]feedEntry{cached, pulled} {
+		for _, e := range batch {
+			if !seen[e.PostID] {
+				seen[e.PostID] = true
+				merged = append(merged, e)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].before(merged[j]) })
+	if len(merged) > feedSize {
+		merged = merged[:feedSize]
+	}
+	return merged
+}
+
+func collectFeedEntries(rows pgx.Rows) ([]feedEntry, error) {
+	defer rows.Close()
+	entries := []feedEntry{}
+	for rows.Next() {
+		e := feedEntry{}
+		if err := rows.Scan(&e.PostID, &e.AuthorID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// loadPosts fetches posts by ID keeping the order of entries. Posts the replica
+// does not have yet (just fanned out) are read from the master; posts deleted
+// since are skipped.
+func loadPosts(ctx context.Context, entries []feedEntry) ([]Post, error) {
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.PostID
+	}
+
+	byId := make(map[string]Post, len(ids))
+	if err := queryPostsByID(ctx, slaveDB, ids, byId); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, id := range ids {
+		if _, ok := byId[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		if err := queryPostsByID(ctx, masterDB, missing, byId); err != nil {
+			return nil, err
+		}
+	}
+
+	posts := make([]Post, 0, len(entries))
+	for _, e := range entries {
+		if p, ok := byId[e.PostID]; ok {
+			posts = append(posts, p)
+		}
+	}
+	return posts, nil
+}
+
+type rowsQuerier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func queryPostsByID(ctx context.Context, db rowsQuerier, ids []string, byId map[string]Post) error {
+	rows, err := db.Query(ctx,
+		"SELECT id::text, text, author_user_id::text, created_at FROM posts WHERE id = ANY($1::text[]::uuid[])", ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := Post{}
+		if err := rows.Scan(&p.ID, &p.Text, &p.AuthorUserID, &p.CreatedAt); err != nil {
+			return err
+		}
+		byId[p.ID] = p
+	}
+	return rows.Err()
+}
+
+// getFeed returns friends' posts newest first. Clients page with ?cursor=
+// (the X-Next-Cursor header of the previous page, empty for the first page);
+// old clients may keep using offset/limit.
+func getFeed(c *gin.Context) {
+	currentUserId := c.GetString("userId")
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit <= 0 {
+		limit = 10
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	var cursor *feedCursor
+	cursorStr, useCursor := c.GetQuery("cursor")
+	if useCursor && cursorStr != "" {
+		decoded, err := decodeFeedCursor(cursorStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid cursor"})
+			return
+		}
+		cursor = &decoded
+	}
+	if useCursor {
+		offset = 0
+	}
+
+	posts, next, ok, err := getFeedFromCache(c.Request.Context(), currentUserId, cursor, offset, limit)
+	if err == nil && !ok {
+		posts, next, err = getFeedFromDB(c.Request.Context(), currentUserId, cursor, offset, limit)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Database error"})
+		return
+	}
+
+	if next != nil {
+		c.Header("X-Next-Cursor", encodeFeedCursor(*next))
+	}
+	c.JSON(http.StatusOK, posts)
+}
+
+// getFeedFromCache serves a page from the materialized feed. ok is false when
+// the page lies beyond the cached window and has to be read from the DB. The
+// next cursor follows the cached entries, so a page that came out shorter
+// because a post was deleted meanwhile does not end the paging.
+func getFeedFromCache(ctx context.Context, userId string, cursor *feedCursor, offset, limit int) ([]Post, *feedCursor, bool, error) {
+	if feedCache == nil {
+		return nil, nil, false, nil
+	}
+
+	feed, hit := feedCache.Get(userId)
+	if !hit {
+		// Build at least as fresh as the master: a feed rebuilt after a
+		// friendship change from a lagging replica would stay stale for FEED_CACHE_TTL
+		buildCtx, err := readAfterMaster(ctx)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		built, err := buildFeed(buildCtx, userId)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		feedCache.Set(userId, built)
+		feed = built
+	}
+
+	entries, err := celebrityPosts(ctx, feed)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	complete := len(entries) < feedSize // the window holds the whole feed
+
+	start := offset
+	if cursor != nil {
+		pos := feedEntry{PostID: cursor.ID, CreatedAt: cursor.CreatedAt}
+		start = sort.Search(len(entries), func(i int) bool { return pos.before(entries[i]) })
+	}
+	end := start + limit
+	if end > len(entries) {
+		if !complete {
+			return nil, nil, false, nil
+		}
+		end = len(entries)
+	}
+	if start >= end {
+		return []Post{}, nil, true, nil
+	}
+
+	posts, err := loadPosts(ctx, entries[start:end])
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var next *feedCursor
+	if end-start == limit {
+		last := entries[end-1]
+		next = &feedCursor{CreatedAt: last.CreatedAt, ID: last.PostID}
+	}
+	return posts, next, true, nil
+}
+
+func getFeedFromDB(ctx context.Context, userId string, cursor *feedCursor, offset, limit int) ([]Post, *feedCursor, error) {
+	var rows pgx.Rows
+	var err error
+	if cursor != nil {
+		rows, err = slaveDB.Query(ctx,
+			`SELECT id::text, text, author_user_id::text, created_at FROM posts
+			 WHERE author_user_id IN (SELECT friend_id FROM friends WHERE user_id = $1::uuid)
+			 AND (created_at, id) < ($2, $3::uuid)
+			 ORDER BY created_at DESC, id DESC LIMIT $4`,
+			userId, cursor.CreatedAt, cursor.ID, limit)
+	} else {
+		rows, err = slaveDB.Query(ctx,
+			`SELECT id::text, text, author_user_id::text, created_at FROM posts
+			 WHERE author_user_id IN (SELECT friend_id FROM friends WHERE user_id = $1::uuid)
+			 ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`,
+			userId, limit, offset)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		p := Post{}
+		if err := rows.Scan(&p.ID, &p.Text, &p.AuthorUserID, &p.CreatedAt); err != nil {
+			return nil, nil, err
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *feedCursor
+	if len(posts) == limit {
+		last := posts[len(posts)-1]
+		next = &feedCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+	return posts, next, nil
+}
+
+// feedCursor is the position of the last post of a page; clients see it only as an opaque string
+type feedCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func encodeFeedCursor(cur feedCursor) string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeFeedCursor(s string) (feedCursor, error) {
+	var cur feedCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return cur, err
+	}
+	if _, err := uuid.Parse(cur.ID); err != nil {
+		return cur, err
+	}
+	return cur, nil
+}
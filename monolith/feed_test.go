@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var feedT0 = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func entryAt(id string, minutes int) feedEntry {
+	return feedEntry{PostID: id, AuthorID: "author", CreatedAt: feedT0.Add(time.Duration(minutes) * time.Minute)}
+}
+
+func entryIDs(entries []feedEntry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.PostID)
+	}
+	return ids
+}
+
+func withFeedSize(t *testing.T, n int) {
+	old := feedSize
+	feedSize = n
+	t.Cleanup(func() { feedSize = old })
+}
+
+func TestFeedCursor(t *testing.T) {
+	id := uuid.NewString()
+	cur := feedCursor{CreatedAt: feedT0.Add(123456789 * time.Nanosecond), ID: id}
+	got, err := decodeFeedCursor(encodeFeedCursor(cur))
+	if err != nil {
+		t.Fatalf("decode of an encoded cursor: %v", err)
+	}
+	if !got.CreatedAt.Equal(cur.CreatedAt) || got.ID != cur.ID {
+		t.Fatalf("round trip gave %+v, want %+v", got, cur)
+	}
+
+	for _, tc := range []struct {
+		name, cursor string
+	}{
+		{"empty", ""},
+		{"not base64", "%%%"},
+		{"not json", encodeRaw("not json")},
+		{"bad id", encodeFeedCursor(feedCursor{CreatedAt: feedT0, ID: "42"})},
+		{"no id", encodeRaw(`{"t":"2024-05-01T12:00:00Z"}`)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decodeFeedCursor(tc.cursor); err == nil {
+				t.Fatalf("cursor %q is accepted", tc.cursor)
+			}
+		})
+	}
+}
+
+func encodeRaw(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func TestMergeFeedEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		size           int
+		cached, pulled []feedEntry
+		want           []string
+	}{
+		{
+			name:   "no celebrities",
+			size:   10,
+			cached: []feedEntry{entryAt("c2", 2), entryAt("c1", 1)},
+			want:   []string{"c2", "c1"},
+		},
+		{
+			name:   "interleaved",
+			size:   10,
+			cached: []feedEntry{entryAt("c4", 4), entryAt("c2", 2)},
+			pulled: []feedEntry{entryAt("p5", 5), entryAt("p3", 3), entryAt("p1", 1)},
+			want:   []string{"p5", "c4", "p3", "c2", "p1"},
+		},
+		{
+			name:   "duplicates",
+			size:   10,
+			cached: []feedEntry{entryAt("x", 3), entryAt("c1", 1)},
+			pulled: []feedEntry{entryAt("x", 3), entryAt("p2", 2)},
+			want:   []string{"x", "p2", "c1"},
+		},
+		{
+			name:   "same time ordered by id",
+			size:   10,
+			cached: []feedEntry{entryAt("a", 1)},
+			pulled: []feedEntry{entryAt("b", 1)},
+			want:   []string{"b", "a"},
+		},
+		{
+			name:   "capped at feed size",
+			size:   3,
+			cached: []feedEntry{entryAt("c4", 4), entryAt("c2", 2)},
+			pulled: []feedEntry{entryAt("p5", 5), entryAt("p3", 3), entryAt("p1", 1)},
+			want:   []string{"p5", "c4", "p3"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withFeedSize(t, tc.size)
+			if got := entryIDs(mergeFeedEntries(tc.cached, tc.pulled)); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("merged %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryFeedCachePushRemove(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		size   int
+		start  []feedEntry
+		push   []feedEntry
+		remove []feedEntry
+		want   []string
+	}{
+		{
+			name:  "in order",
+			size:  10,
+			start: []feedEntry{entryAt("e3", 3), entryAt("e1", 1)},
+			push:  []feedEntry{entryAt("e4", 4), entryAt("e2", 2), entryAt("e0", 0)},
+			want:  []string{"e4", "e3", "e2", "e1", "e0"},
+		},
+		{
+			name:  "twice",
+			size:  10,
+			start: []feedEntry{entryAt("e1", 1)},
+			push:  []feedEntry{entryAt("e2", 2), entryAt("e2", 2)},
+			want:  []string{"e2", "e1"},
+		},
+		{
+			name:  "older than a full feed",
+			size:  2,
+			start: []feedEntry{entryAt("e3", 3), entryAt("e2", 2)},
+			push:  []feedEntry{entryAt("e1", 1)},
+			want:  []string{"e3", "e2"},
+		},
+		{
+			name:  "newest drops the oldest",
+			size:  2,
+			start: []feedEntry{entryAt("e3", 3), entryAt("e2", 2)},
+			push:  []feedEntry{entryAt("e4", 4)},
+			want:  []string{"e4", "e3"},
+		},
+		{
+			name:   "remove",
+			size:   10,
+			start:  []feedEntry{entryAt("e3", 3), entryAt("e2", 2), entryAt("e1", 1)},
+			remove: []feedEntry{entryAt("e2", 2), entryAt("missing", 2)},
+			want:   []string{"e3", "e1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withFeedSize(t, tc.size)
+			m := newMemoryFeedCache(10, time.Minute)
+			m.Set("u", &cachedFeed{Entries: tc.start})
+			for _, e := range tc.push {
+				m.Push("u", e)
+			}
+			for _, e := range tc.remove {
+				m.Remove("u", e)
+			}
+			feed, ok := m.Get("u")
+			if !ok {
+				t.Fatal("feed is not cached")
+			}
+			if got := entryIDs(feed.Entries); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("feed %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	m := newMemoryFeedCache(10, time.Minute)
+	m.Push("u", entryAt("e1", 1))
+	if _, ok := m.Get("u"); ok {
+		t.Fatal("push created a feed that was not cached")
+	}
+}
+
+func TestMemoryFeedCacheEviction(t *testing.T) {
+	m := newMemoryFeedCache(2, time.Minute)
+	m.Set("a", &cachedFeed{})
+	m.Set("b", &cachedFeed{})
+	m.Get("a") // b is now the least recently used
+	m.Set("c", &cachedFeed{})
+
+	for _, tc := range []struct {
+		user   string
+		cached bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	} {
+		if _, ok := m.Get(tc.user); ok != tc.cached {
+			t.Errorf("feed of %s cached = %v, want %v", tc.user, ok, tc.cached)
+		}
+	}
+	if m.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", m.Len())
+	}
+}
+
+func TestMemoryFeedCacheTTL(t *testing.T) {
+	m := newMemoryFeedCache(10, time.Minute)
+	m.Set("fresh", &cachedFeed{})
+	m.Set("stale", &cachedFeed{})
+	m.items["stale"].Value.(*memoryFeedItem).builtAt = time.Now().Add(-time.Minute - time.Second)
+
+	if _, ok := m.Get("fresh"); !ok {
+		t.Fatal("a fresh feed is not returned")
+	}
+	if _, ok := m.Get("stale"); ok {
+		t.Fatal("a feed is returned past its TTL")
+	}
+	if m.Len() != 1 {
+		t.Fatalf("an expired feed is kept: Len() = %d", m.Len())
+	}
+}
+
+func TestFriendsChangedInvalidatesFeed(t *testing.T) {
+	oldCache, oldMaster := feedCache, masterDB
+	t.Cleanup(func() { feedCache, masterDB = oldCache, oldMaster })
+
+	// Nothing listens on port 1, so the cross-instance notification fails fast and is only logged
+	pool, err := pgxpool.New(context.Background(), "postgres://test@127.0.0.1:1/test?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	masterDB = newMasterPool(pool)
+
+	cache := newMemoryFeedCache(10, time.Minute)
+	feedCache = cache
+	cache.Set("u1", &cachedFeed{Entries: []feedEntry{entryAt("e1", 1)}})
+	cache.Set("u2", &cachedFeed{Entries: []feedEntry{entryAt("e1", 1)}})
+
+	friendsChanged(context.Background(), "u1")
+	if _, ok := cache.Get("u1"); ok {
+		t.Fatal("the feed survived a friendship change")
+	}
+	if _, ok := cache.Get("u2"); !ok {
+		t.Fatal("another user's feed was dropped")
+	}
+
+	// Other instances drop the feed when the notification arrives
+	invalidateFeed("u2")
+	if _, ok := cache.Get("u2"); ok {
+		t.Fatal("the feed survived an invalidation notice")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"social-network-common/env"
+	"social-network-common/jwtkeys"
+)
+
+// Access tokens are JWTs signed by the monolith and verified locally by both
+// the monolith and dialog-service. Keys are addressed by kid, so a new key can
+// be rolled out for signing while tokens signed with the old one stay valid.
+//
+// Configuration:
+//
+//	JWT_ALG              HS256 (default) or RS256 — algorithm for new tokens
+//	JWT_ACTIVE_KID       kid used for signing (defaults to the first key)
+//	JWT_HMAC_KEYS        kid:secret,kid:secret
+//	JWT_RSA_PRIVATE_KEYS kid:/path/private.pem,...
+//	JWT_RSA_PUBLIC_KEYS  kid:/path/public.pem,... (verification only, e.g. retired keys)
+//	JWT_ISSUER           token issuer (social-network-monolith)
+//	JWT_AUDIENCE         token audience (social-network)
+//	JWT_TTL              access token lifetime (15m)
+//	JWT_INSECURE_DEV     1 to sign with a published development key when no keys are set
+//
+// Without keys the monolith refuses to start.
+type jwtKeyring struct {
+	alg        string
+	activeKid  string
+	signKeys   map[string]any // kid -> []byte | *rsa.PrivateKey
+	verifyKeys map[string]any // kid -> []byte | *rsa.PublicKey
+	issuer     string
+	audience   string
+	ttl        time.Duration
+}
+
+type accessClaims struct {
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+var jwtKeys *jwtKeyring // loaded in main
+
+func loadJWTKeyring() (*jwtKeyring, error) {
+	k := &jwtKeyring{
+		alg:        strings.ToUpper(env.OrDefault("JWT_ALG", "HS256")),
+		signKeys:   make(map[string]any),
+		verifyKeys: make(map[string]any),
+		issuer:     env.OrDefault("JWT_ISSUER", "social-network-monolith"),
+		audience:   env.OrDefault("JWT_AUDIENCE", "social-network"),
+		ttl:        envDuration("JWT_TTL", 15*time.Minute),
+	}
+
+	var firstKid string
+	for _, kv := range jwtkeys.SplitKeyList(os.Getenv("JWT_HMAC_KEYS")) {
+		secret := []byte(kv[1])
+		if k.alg == "HS256" {
+			k.signKeys[kv[0]] = secret
+			if firstKid == "" {
+				firstKid = kv[0]
+			}
+		}
+		k.verifyKeys[kv[0]] = secret
+	}
+	for _, kv := range jwtkeys.SplitKeyList(os.Getenv("JWT_RSA_PRIVATE_KEYS")) {
+		pemBytes, err := os.ReadFile(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("read private key %s: %w", kv[0], err)
+		}
+		priv, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse private key %s: %w", kv[0], err)
+		}
+		if k.alg == "RS256" {
+			k.signKeys[kv[0]] = priv
+			if firstKid == "" {
+				firstKid = kv[0]
+			}
+		}
+		k.verifyKeys[kv[0]] = &priv.PublicKey
+	}
+	if err := jwtkeys.LoadRSAPublicKeys(os.Getenv("JWT_RSA_PUBLIC_KEYS"), k.verifyKeys); err != nil {
+		return nil, err
+	}
+
+	if k.alg != "HS256" && k.alg != "RS256" {
+		return nil, fmt.Errorf("unsupported JWT_ALG %q", k.alg)
+	}
+	if len(k.signKeys) == 0 {
+		if k.alg != "HS256" || len(k.verifyKeys) > 0 {
+			return nil, fmt.Errorf("no %s signing keys configured", k.alg)
+		}
+		kid, secret, err := jwtkeys.DevKey()
+		if err != nil {
+			return nil, err
+		}
+		k.signKeys[kid] = secret
+		k.verifyKeys[kid] = secret
+		firstKid = kid
+	}
+
+	k.activeKid = env.OrDefault("JWT_ACTIVE_KID", firstKid)
+	if _, ok := k.signKeys[k.activeKid]; !ok {
+		return nil, fmt.Errorf("JWT_ACTIVE_KID %q has no %s signing key", k.activeKid, k.alg)
+	}
+	return k, nil
+}
+
+func (k *jwtKeyring) Issue(userId, sessionId string) (string, time.Time, error) {
+	return k.issue(userId, sessionId, k.ttl)
+}
+
+func (k *jwtKeyring) issue(userId, sessionId string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	claims := accessClaims{
+		SessionID: sessionId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   userId,
+			Issuer:    k.issuer,
+			Audience:  jwt.ClaimStrings{k.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(k.alg), claims)
+	token.Header["kid"] = k.activeKid
+	signed, err := token.SignedString(k.signKeys[k.activeKid])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+func (k *jwtKeyring) Verify(tokenString string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, jwtkeys.KeyFunc(k.verifyKeys),
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithIssuer(k.issuer),
+		jwt.WithAudience(k.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// dialog-service cannot see the sessions, so it only accepts access tokens
+// issued at most DIALOG_TOKEN_MAX_AGE (5m) ago: that bounds how long a revoked
+// session keeps working there. The proxy has checked the session already and
+// forwards a short-lived token of its own instead of the client's, reused for
+// half of that age.
+var dialogTokenMaxAge = envDuration("DIALOG_TOKEN_MAX_AGE", 5*time.Minute)
+
+var dialogTokens = &dialogTokenCache{tokens: make(map[string]dialogToken)}
+
+type dialogToken struct {
+	token    string
+	issuedAt time.Time
+}
+
+// dialogTokenCache holds the token forwarded to dialog-service per session
+type dialogTokenCache struct {
+	mu         sync.Mutex
+	tokens     map[string]dialogToken
+	lastPurged time.Time
+}
+
+// get returns a token for the session, issuing a new one when the cached one
+// is older than half of dialogTokenMaxAge
+func (d *dialogTokenCache) get(userId, sessionId string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastPurged) > dialogTokenMaxAge {
+		for id, t := range d.tokens {
+			if now.Sub(t.issuedAt) > dialogTokenMaxAge/2 {
+				delete(d.tokens, id)
+			}
+		}
+		d.lastPurged = now
+	}
+	if t, ok := d.tokens[sessionId]; ok && now.Sub(t.issuedAt) <= dialogTokenMaxAge/2 {
+		return t.token, nil
+	}
+	token, _, err := jwtKeys.issue(userId, sessionId, dialogTokenMaxAge)
+	if err != nil {
+		return "", err
+	}
+	d.tokens[sessionId] = dialogToken{token: token, issuedAt: now}
+	return token, nil
+}
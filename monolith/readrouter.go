@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"social-network-common/env"
+	"social-network-common/pglsn"
+)
+
+// Reads go through slaveDB, a router over the replica pools from
+// READ_REPLICAS (name=url,name=url; SLAVE_DB_URL is a single replica when it
+// is not set). Every replica is pinged each READ_HEALTH_INTERVAL (5s); one that
+// fails the ping or a query at the connection level leaves the rotation until
+// a ping succeeds again, and the query is retried on the next replica.
+// Healthy replicas are picked by READ_BALANCER: round-robin (default) or
+// least-outstanding (fewest queries in flight). With no healthy replica reads
+// fall back to masterDB.
+//
+// The same check measures replication lag: a replica that has replayed the
+// WAL up to the master's pg_current_wal_lsn() read just before is caught up.
+// A replica behind by more than READ_LAG_MIN_BYTES (64kB) lags by the time
+// since its last replayed transaction (pg_last_xact_replay_timestamp). Below
+// that it counts as caught up: an idle master still writes a little WAL
+// (checkpoints, running transaction snapshots) with no transactions, so the
+// timestamp may be far in the past while nothing is missing. Replicas lagging
+// more than READ_MAX_LAG (1s) are skipped like unhealthy ones.
+const balancerLeastOutstanding = "least-outstanding"
+
+var (
+	readMaxLag      = envDuration("READ_MAX_LAG", time.Second)
+	readLagMinBytes = int64(envInt("READ_LAG_MIN_BYTES", 64<<10))
+)
+
+// replicaDB is the part of a pool the router queries; tests use in-memory fakes
+type replicaDB interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type replica struct {
+	name        string
+	pool        *pgxpool.Pool
+	db          replicaDB // pool outside of tests
+	outstanding atomic.Int64
+
+	// guarded by readRouter.mu
+	healthy   bool
+	lastError string
+	replayLSN pglsn.LSN
+	lag       time.Duration
+	lagBytes  int64 // -1 when the master LSN is unknown
+}
+
+type readRouter struct {
+	policy   string
+	next     atomic.Uint64
+	fallback replicaDB // nil means masterDB
+
+	mu       sync.RWMutex
+	replicas []*replica // sorted by name
+}
+
+func newReadRouter(replicas []*replica) *readRouter {
+	r := &readRouter{policy: env.OrDefault("READ_BALANCER", balancerRoundRobin)}
+	if r.policy != balancerRoundRobin && r.policy != balancerLeastOutstanding {
+		log.Printf("Unknown READ_BALANCER %q, using %s", r.policy, balancerRoundRobin)
+		r.policy = balancerRoundRobin
+	}
+	r.setReplicas(replicas)
+	return r
+}
+
+// connectReplicas opens the pools of READ_REPLICAS
+func connectReplicas(ctx context.Context) ([]*replica, error) {
+	urls, err := env.ParseList(os.Getenv("READ_REPLICAS"))
+	if err != nil {
+		return nil, fmt.Errorf("READ_REPLICAS: %w", err)
+	}
+	if len(urls) == 0 {
+		urls = map[string]string{"slave": os.Getenv("SLAVE_DB_URL")}
+	}
+
+	var replicas []*replica
+	for name, url := range urls {
+		rep, err := newReplica(ctx, name, url)
+		if err != nil {
+			for _, rep := range replicas {
+				rep.pool.Close()
+			}
+			return nil, err
+		}
+		replicas = append(replicas, rep)
+	}
+	return replicas, nil
+}
+
+func newReplica(ctx context.Context, name, url string) (*replica, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	// Healthy until the first check says otherwise, like dialog-service endpoints
+	return &replica{name: name, pool: pool, db: pool, healthy: true, lagBytes: -1}, nil
+}
+
+// setReplicas replaces the replica set (see topology.go); replicas keep their state
+func (r *readRouter) setReplicas(replicas []*replica) {
+	replicas = slices.Clone(replicas)
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].name < replicas[j].name })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicas = replicas
+}
+
+func (r *readRouter) all() []*replica {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.replicas
+}
+
+// master is where reads go when no replica can take them
+func (r *readRouter) master() replicaDB {
+	if r.fallback != nil {
+		return r.fallback
+	}
+	return masterDB
+}
+
+func (r *readRouter) Close() {
+	for _, rep := range r.all() {
+		rep.pool.Close()
+	}
+}
+
+// pick chooses a healthy replica known to have replayed the WAL up to
+// minLSN; nil means reads go to the master
+func (r *readRouter) pick(minLSN pglsn.LSN) *replica {
+	r.mu.RLock()
+	healthy := make([]*replica, 0, len(r.replicas))
+	for _, rep := range r.replicas {
+		if rep.healthy && rep.lag <= readMaxLag && rep.replayLSN >= minLSN {
+			healthy = append(healthy, rep)
+		}
+	}
+	r.mu.RUnlock()
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	start := int(r.next.Add(1) % uint64(len(healthy)))
+	if r.policy == balancerRoundRobin {
+		return healthy[start]
+	}
+	best := healthy[start]
+	for i := 1; i < len(healthy); i++ {
+		if rep := healthy[(start+i)%len(healthy)]; rep.outstanding.Load() < best.outstanding.Load() {
+			best = rep
+		}
+	}
+	return best
+}
+
+func (r *readRouter) setHealth(rep *replica, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	healthy := err == nil
+	if healthy != rep.healthy {
+		if healthy {
+			log.Printf("Read replica %s is back", rep.name)
+		} else {
+			log.Printf("Read replica %s removed from rotation: %v", rep.name, err)
+		}
+	}
+	rep.healthy = healthy
+	rep.lastError = ""
+	if err != nil {
+		rep.lastError = err.Error()
+	}
+}
+
+// pickFor chooses a replica for a read of ctx (see readyourwrites.go). If no
+// replica had replayed the WAL up to readAfter(ctx) by the last check, one is
+// asked again until it has or READ_YOUR_WRITES_WAIT passes.
+func (r *readRouter) pickFor(ctx context.Context) *replica {
+	minLSN := readAfter(ctx)
+	if rep := r.pick(minLSN); rep != nil || minLSN == 0 {
+		return rep
+	}
+	rep := r.pick(0)
+	if rep == nil {
+		return nil
+	}
+
+	deadline := time.Now().Add(readYourWritesWait)
+	for {
+		var replayed bool
+		err := rep.db.QueryRow(ctx,
+			"SELECT COALESCE(pg_last_wal_replay_lsn() >= $1::pg_lsn, true)", minLSN.String()).Scan(&replayed)
+		if err != nil {
+			return nil
+		}
+		if replayed {
+			r.mu.Lock()
+			rep.replayLSN = max(rep.replayLSN, minLSN)
+			r.mu.Unlock()
+			return rep
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (r *readRouter) setLag(rep *replica, replayLSN pglsn.LSN, lag time.Duration, lagBytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if wasLagging, lagging := rep.lag > readMaxLag, lag > readMaxLag; wasLagging != lagging {
+		if lagging {
+			log.Printf("Read replica %s lags %s behind the master, skipping it", rep.name, lag.Round(time.Millisecond))
+		} else {
+			log.Printf("Read replica %s caught up", rep.name)
+		}
+	}
+	rep.replayLSN, rep.lag, rep.lagBytes = replayLSN, lag, lagBytes
+}
+
+// failed reports whether err means the replica itself is unusable (as opposed
+// to a bad query or no rows) and takes the replica out of rotation if so
+func (r *readRouter) failed(ctx context.Context, rep *replica, err error) bool {
+	if ctx.Err() != nil || !isConnectionError(err) {
+		return false
+	}
+	r.setHealth(rep, err)
+	return true
+}
+
+func isConnectionError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// 08 - connection exception, 57P - operator intervention (shutdown, recovery)
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P")
+	}
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connectErr) || errors.As(err, &netErr) ||
+		pgconn.SafeToRetry(err) || pgconn.Timeout(err)
+}
+
+func (r *readRouter) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	for range r.all() {
+		rep := r.pickFor(ctx)
+		if rep == nil {
+			break
+		}
+		rep.outstanding.Add(1)
+		rows, err := rep.db.Query(ctx, sql, args...)
+		if err == nil {
+			return &replicaRows{Rows: rows, rep: rep}, nil
+		}
+		rep.outstanding.Add(-1)
+		if !r.failed(ctx, rep, err) {
+			return nil, err
+		}
+	}
+	return r.master().Query(ctx, sql, args...)
+}
+
+// QueryRow defers the query to Scan, where a replica failure is still retryable
+func (r *readRouter) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &routedRow{router: r, ctx: ctx, sql: sql, args: args}
+}
+
+type routedRow struct {
+	router *readRouter
+	ctx    context.Context
+	sql    string
+	args   []any
+}
+
+func (row *routedRow) Scan(dest ...any) error {
+	r := row.router
+	for range r.all() {
+		rep := r.pickFor(row.ctx)
+		if rep == nil {
+			break
+		}
+		rep.outstanding.Add(1)
+		err := rep.db.QueryRow(row.ctx, row.sql, row.args...).Scan(dest...)
+		rep.outstanding.Add(-1)
+		if err == nil || !r.failed(row.ctx, rep, err) {
+			return err
+		}
+	}
+	return r.master().QueryRow(row.ctx, row.sql, row.args...).Scan(dest...)
+}
+
+// replicaRows keeps the query counted as outstanding until the rows are done
+type replicaRows struct {
+	pgx.Rows
+	rep  *replica
+	once sync.Once
+}
+
+func (rows *replicaRows) done() {
+	rows.once.Do(func() { rows.rep.outstanding.Add(-1) })
+}
+
+func (rows *replicaRows) Next() bool {
+	if rows.Rows.Next() {
+		return true
+	}
+	rows.done()
+	return false
+}
+
+func (rows *replicaRows) Close() {
+	rows.Rows.Close()
+	rows.done()
+}
+
+// checkReplicas checks the replicas and measures their lag until ctx is done
+func (r *readRouter) checkReplicas(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// The master position is read first, so a replica that has reached it is caught up
+		var masterLSN pglsn.LSN
+		masterCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := masterDB.QueryRow(masterCtx, "SELECT pg_current_wal_lsn()::text").Scan(&masterLSN)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to read the master WAL position: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for _, rep := range r.all() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				checkCtx, cancel := context.WithTimeout(ctx, time.Second)
+				defer cancel()
+				err := r.measureLag(checkCtx, rep, masterLSN)
+				if ctx.Err() == nil {
+					r.setHealth(rep, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// measureLag doubles as the health check of the replica; masterLSN is 0 if unknown
+func (r *readRouter) measureLag(ctx context.Context, rep *replica, masterLSN pglsn.LSN) error {
+	var replayLSN, receiveLSN *pglsn.LSN
+	var sinceReplay time.Duration
+	err := rep.db.QueryRow(ctx, `
+		SELECT pg_last_wal_replay_lsn()::text, pg_last_wal_receive_lsn()::text,
+		       COALESCE(now() - pg_last_xact_replay_timestamp(), interval '0')`).
+		Scan(&replayLSN, &receiveLSN, &sinceReplay)
+	if err != nil {
+		return err
+	}
+	if replayLSN == nil {
+		// Not in recovery: a promoted replica is as fresh as it gets
+		r.setLag(rep, 0, 0, 0)
+		return nil
+	}
+
+	lag, lagBytes := time.Duration(0), int64(-1)
+	if masterLSN != 0 {
+		lagBytes = 0
+		if *replayLSN < masterLSN {
+			lagBytes = int64(masterLSN - *replayLSN)
+		}
+		if lagBytes > readLagMinBytes {
+			lag = sinceReplay
+		}
+	} else if receiveLSN == nil || int64(*receiveLSN-*replayLSN) > readLagMinBytes {
+		// Without the master only the WAL received but not yet replayed is visible
+		lag = sinceReplay
+	}
+	r.setLag(rep, *replayLSN, lag, lagBytes)
+	return nil
+}
+
+type replicaStatus struct {
+	Name        string  `json:"name"`
+	Healthy     bool    `json:"healthy"`
+	Outstanding int64   `json:"outstanding"`
+	LastError   string  `json:"last_error,omitempty"`
+	ReplayLSN   string  `json:"replay_lsn,omitempty"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	LagBytes    *int64  `json:"lag_bytes,omitempty"`
+	Lagging     bool    `json:"lagging"`
+}
+
+type readRouterStatus struct {
+	Balancer      string          `json:"balancer"`
+	MaxLagSeconds float64         `json:"max_lag_seconds"`
+	Replicas      []replicaStatus `json:"replicas"`
+}
+
+func (r *readRouter) status() readRouterStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := readRouterStatus{
+		Balancer:      r.policy,
+		MaxLagSeconds: readMaxLag.Seconds(),
+		Replicas:      make([]replicaStatus, 0, len(r.replicas)),
+	}
+	for _, rep := range r.replicas {
+		st := replicaStatus{
+			Name:        rep.name,
+			Healthy:     rep.healthy,
+			Outstanding: rep.outstanding.Load(),
+			LastError:   rep.lastError,
+			LagSeconds:  rep.lag.Seconds(),
+			Lagging:     rep.lag > readMaxLag,
+		}
+		if rep.replayLSN != 0 {
+			st.ReplayLSN = rep.replayLSN.String()
+		}
+		if lagBytes := rep.lagBytes; lagBytes >= 0 {
+			st.LagBytes = &lagBytes
+		}
+		result.Replicas = append(result.Replicas, st)
+	}
+	return result
+}
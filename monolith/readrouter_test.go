@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"social-network-common/pglsn"
+)
+
+var (
+	errReplicaDown = &pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"}
+	errBadQuery    = &pgconn.PgError{Code: "42P01", Message: `relation "nope" does not exist`}
+)
+
+// fakeReplicaDB is an in-memory replicaDB: answer gives the row of a query
+// (nil values are NULL) or its error; Query returns the given number of rows
+type fakeReplicaDB struct {
+	answer  func(sql string) ([]any, error)
+	rows    int // rows of every Query
+	queries atomic.Int32
+}
+
+func answering(values ...any) *fakeReplicaDB {
+	return &fakeReplicaDB{answer: func(string) ([]any, error) { return values, nil }}
+}
+
+func failing(err error) *fakeReplicaDB {
+	return &fakeReplicaDB{answer: func(string) ([]any, error) { return nil, err }}
+}
+
+func (f *fakeReplicaDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	f.queries.Add(1)
+	if _, err := f.answer(sql); err != nil {
+		return nil, err
+	}
+	return &fakeRows{left: f.rows}, nil
+}
+
+func (f *fakeReplicaDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	f.queries.Add(1)
+	values, err := f.answer(sql)
+	return fakeRow{values: values, err: err}
+}
+
+type fakeRow struct {
+	values []any
+	err    error
+}
+
+func (row fakeRow) Scan(dest ...any) error {
+	if row.err != nil {
+		return row.err
+	}
+	if len(dest) != len(row.values) {
+		return fmt.Errorf("%d columns scanned into %d destinations", len(row.values), len(dest))
+	}
+	for i, d := range dest {
+		if err := scanFake(d, row.values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanFake(dest, src any) error {
+	if s, ok := dest.(sql.Scanner); ok {
+		return s.Scan(src)
+	}
+	v := reflect.ValueOf(dest).Elem()
+	switch {
+	case src == nil:
+		v.SetZero()
+	case v.Kind() == reflect.Pointer:
+		// a nullable column such as **pglsn.LSN
+		p := reflect.New(v.Type().Elem())
+		if err := scanFake(p.Interface(), src); err != nil {
+			return err
+		}
+		v.Set(p)
+	default:
+		v.Set(reflect.ValueOf(src).Convert(v.Type()))
+	}
+	return nil
+}
+
+type fakeRows struct {
+	left   int
+	closed bool
+}
+
+func (r *fakeRows) Close()                                       { r.closed = true }
+func (r *fakeRows) Err() error                                   { return nil }
+func (r *fakeRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *fakeRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *fakeRows) Scan(dest ...any) error                       { return nil }
+func (r *fakeRows) Values() ([]any, error)                       { return nil, nil }
+func (r *fakeRows) RawValues() [][]byte                          { return nil }
+func (r *fakeRows) Conn() *pgx.Conn                              { return nil }
+
+func (r *fakeRows) Next() bool {
+	if r.closed || r.left == 0 {
+		return false
+	}
+	r.left--
+	return true
+}
+
+func fakeReplica(name string, db *fakeReplicaDB) *replica {
+	return &replica{name: name, db: db, healthy: true, lagBytes: -1}
+}
+
+func testRouter(policy string, master *fakeReplicaDB, replicas ...*replica) *readRouter {
+	r := &readRouter{policy: policy}
+	if master != nil {
+		r.fallback = master
+	}
+	r.next.Store(math.MaxUint64) // the first pick starts from the first replica
+	r.setReplicas(replicas)
+	return r
+}
+
+func TestIsConnectionError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection failure", &pgconn.PgError{Code: "08006"}, true},
+		{"admin shutdown", errReplicaDown, true},
+		{"cannot connect now", &pgconn.PgError{Code: "57P03"}, true},
+		{"wrapped", fmt.Errorf("query: %w", &pgconn.PgError{Code: "08003"}), true},
+		{"connect error", &pgconn.ConnectError{}, true},
+		{"network", &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{"undefined table", errBadQuery, false},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"query canceled", &pgconn.PgError{Code: "57014"}, false},
+		{"no rows", pgx.ErrNoRows, false},
+		{"other", errors.New("boom"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isConnectionError(tc.err); got != tc.want {
+				t.Fatalf("isConnectionError = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPickSkipsUnusableReplicas(t *testing.T) {
+	type state struct {
+		name      string
+		healthy   bool
+		lag       time.Duration
+		replayLSN pglsn.LSN
+	}
+	for _, tc := range []struct {
+		name     string
+		replicas []state
+		minLSN   pglsn.LSN
+		want     []string
+	}{
+		{"all usable", []state{{"a", true, 0, 0}, {"b", true, 0, 0}}, 0, []string{"a", "b"}},
+		{"unhealthy", []state{{"a", true, 0, 0}, {"b", false, 0, 0}}, 0, []string{"a"}},
+		{"lagging", []state{{"a", true, readMaxLag + time.Millisecond, 0}, {"b", true, 0, 0}}, 0, []string{"b"}},
+		{"lag at the limit", []state{{"a", true, readMaxLag, 0}}, 0, []string{"a"}},
+		{"behind the write", []state{{"a", true, 0, 100}, {"b", true, 0, 200}}, 150, []string{"b"}},
+		{"at the write", []state{{"a", true, 0, 150}}, 150, []string{"a"}},
+		{"none usable", []state{{"a", false, 0, 0}, {"b", true, readMaxLag + time.Second, 0}}, 0, nil},
+		{"no replicas", nil, 0, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var replicas []*replica
+			for _, s := range tc.replicas {
+				rep := fakeReplica(s.name, answering())
+				rep.healthy, rep.lag, rep.replayLSN = s.healthy, s.lag, s.replayLSN
+				replicas = append(replicas, rep)
+			}
+			r := testRouter(balancerRoundRobin, nil, replicas...)
+
+			seen := map[string]bool{}
+			for i := 0; i < 10; i++ {
+				if rep := r.pick(tc.minLSN); rep != nil {
+					seen[rep.name] = true
+				}
+			}
+			var got []string
+			for name := range seen {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("picked %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPickLeastOutstanding(t *testing.T) {
+	a, b, c := fakeReplica("a", answering()), fakeReplica("b", answering()), fakeReplica("c", answering())
+	a.outstanding.Store(2)
+	c.outstanding.Store(1)
+	r := testRouter(balancerLeastOutstanding, nil, a, b, c)
+
+	for i := 0; i < 6; i++ {
+		if rep := r.pick(0); rep != b {
+			t.Fatalf("picked %s, want the idle b", rep.name)
+		}
+	}
+}
+
+func TestPickForWaitsForReplay(t *testing.T) {
+	old := readYourWritesWait
+	readYourWritesWait = 20 * time.Millisecond
+	t.Cleanup(func() { readYourWritesWait = old })
+	ctx := context.WithValue(context.Background(), readAfterContextKey{}, pglsn.LSN(200))
+
+	rep := fakeReplica("a", answering(true))
+	rep.replayLSN = 100
+	if got := testRouter(balancerRoundRobin, nil, rep).pickFor(ctx); got != rep {
+		t.Fatal("a replica that has replayed the write is not picked")
+	}
+	if rep.replayLSN != 200 {
+		t.Fatalf("replay position %s after the check, want 0/C8", rep.replayLSN)
+	}
+
+	rep = fakeReplica("a", answering(false))
+	rep.replayLSN = 100
+	if got := testRouter(balancerRoundRobin, nil, rep).pickFor(ctx); got != nil {
+		t.Fatal("a replica behind the write is picked after READ_YOUR_WRITES_WAIT")
+	}
+}
+
+// routing cases shared by Query and QueryRow
+var routingCases = []struct {
+	name          string
+	replicas      []error // nil is a working replica
+	wantErr       error
+	wantMaster    bool
+	wantUnhealthy []string
+}{
+	{"replica answers", []error{nil}, nil, false, nil},
+	{"fails over to the next replica", []error{errReplicaDown, nil}, nil, false, []string{"r0"}},
+	{"falls back to the master", []error{errReplicaDown, errReplicaDown}, nil, true, []string{"r0", "r1"}},
+	{"no replicas", nil, nil, true, nil},
+	{"query error is returned", []error{errBadQuery, errBadQuery}, errBadQuery, false, nil},
+}
+
+func routingReplicas(errs []error) []*replica {
+	var replicas []*replica
+	for i, err := range errs {
+		db := answering(1)
+		if err != nil {
+			db = failing(err)
+		}
+		db.rows = 2
+		replicas = append(replicas, fakeReplica(fmt.Sprintf("r%d", i), db))
+	}
+	return replicas
+}
+
+func checkRouting(t *testing.T, replicas []*replica, master *fakeReplicaDB, wantMaster bool, wantUnhealthy []string) {
+	t.Helper()
+	if used := master.queries.Load() > 0; used != wantMaster {
+		t.Errorf("master used = %v, want %v", used, wantMaster)
+	}
+	var unhealthy []string
+	for _, rep := range replicas {
+		if !rep.healthy {
+			unhealthy = append(unhealthy, rep.name)
+		}
+	}
+	if !reflect.DeepEqual(unhealthy, wantUnhealthy) {
+		t.Errorf("replicas out of rotation %v, want %v", unhealthy, wantUnhealthy)
+	}
+}
+
+func TestQueryRouting(t *testing.T) {
+	for _, tc := range routingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			replicas := routingReplicas(tc.replicas)
+			master := answering(1)
+			rows, err := testRouter(balancerRoundRobin, master, replicas...).Query(context.Background(), "SELECT 1")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if err == nil {
+				rows.Close()
+			}
+			checkRouting(t, replicas, master, tc.wantMaster, tc.wantUnhealthy)
+			for _, rep := range replicas {
+				if n := rep.outstanding.Load(); n != 0 {
+					t.Errorf("%s has %d outstanding queries after Close", rep.name, n)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryRowRouting(t *testing.T) {
+	for _, tc := range routingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			replicas := routingReplicas(tc.replicas)
+			master := answering(1)
+			var n int
+			err := testRouter(balancerRoundRobin, master, replicas...).QueryRow(context.Background(), "SELECT 1").Scan(&n)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if err == nil && n != 1 {
+				t.Fatalf("scanned %d, want 1", n)
+			}
+			checkRouting(t, replicas, master, tc.wantMaster, tc.wantUnhealthy)
+		})
+	}
+}
+
+func TestQueryOnCanceledContextKeepsReplica(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rep := fakeReplica("a", failing(errReplicaDown))
+	master := answering()
+	if _, err := testRouter(balancerRoundRobin, master, rep).Query(ctx, "SELECT 1"); !errors.Is(err, errReplicaDown) {
+		t.Fatalf("err = %v, want the replica's error", err)
+	}
+	if !rep.healthy || master.queries.Load() != 0 {
+		t.Fatal("a canceled query took the replica out of rotation")
+	}
+}
+
+func TestReplicaRowsOutstanding(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		read func(pgx.Rows)
+	}{
+		{"read to the end", func(rows pgx.Rows) {
+			for rows.Next() {
+			}
+		}},
+		{"closed early", func(rows pgx.Rows) {
+			rows.Next()
+			rows.Close()
+		}},
+		{"read and closed", func(rows pgx.Rows) {
+			for rows.Next() {
+			}
+			rows.Close()
+			rows.Close()
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := answering()
+			db.rows = 3
+			rep := fakeReplica("a", db)
+			rows, err := testRouter(balancerLeastOutstanding, nil, rep).Query(context.Background(), "SELECT 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := rep.outstanding.Load(); n != 1 {
+				t.Fatalf("%d outstanding while the rows are open, want 1", n)
+			}
+			tc.read(rows)
+			if n := rep.outstanding.Load(); n != 0 {
+				t.Fatalf("%d outstanding after the rows are done, want 0", n)
+			}
+		})
+	}
+}
+
+func TestMeasureLag(t *testing.T) {
+	const replay = pglsn.LSN(0x3_0000_0000)
+	lsn := func(l pglsn.LSN) any { return l.String() }
+	for _, tc := range []struct {
+		name         string
+		row          []any // replay LSN, receive LSN, time since the last replayed transaction
+		masterLSN    pglsn.LSN
+		wantLag      time.Duration
+		wantBytes    int64
+		wantReplayed pglsn.LSN
+	}{
+		{"promoted", []any{nil, nil, time.Duration(0)}, replay, 0, 0, 0},
+		{"caught up", []any{lsn(replay), lsn(replay), 5 * time.Minute}, replay, 0, 0, replay},
+		{"a little behind an idle master", []any{lsn(replay), lsn(replay), 5 * time.Minute}, replay + 1000, 0, 1000, replay},
+		{"behind", []any{lsn(replay), lsn(replay), 5 * time.Second}, replay + 1<<20, 5 * time.Second, 1 << 20, replay},
+		{"master unknown, replayed all received", []any{lsn(replay), lsn(replay), 5 * time.Minute}, 0, 0, -1, replay},
+		{"master unknown, replay behind", []any{lsn(replay), lsn(replay + 1<<20), 2 * time.Second}, 0, 2 * time.Second, -1, replay},
+		{"master unknown, nothing received", []any{lsn(replay), nil, 2 * time.Second}, 0, 2 * time.Second, -1, replay},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rep := fakeReplica("a", answering(tc.row...))
+			r := testRouter(balancerRoundRobin, nil, rep)
+			if err := r.measureLag(context.Background(), rep, tc.masterLSN); err != nil {
+				t.Fatal(err)
+			}
+			if rep.lag != tc.wantLag || rep.lagBytes != tc.wantBytes || rep.replayLSN != tc.wantReplayed {
+				t.Fatalf("lag %s, %d bytes, replayed %s; want %s, %d bytes, replayed %s",
+					rep.lag, rep.lagBytes, rep.replayLSN, tc.wantLag, tc.wantBytes, tc.wantReplayed)
+			}
+		})
+	}
+
+	rep := fakeReplica("a", failing(errReplicaDown))
+	rep.lag = 3 * time.Second
+	if err := testRouter(balancerRoundRobin, nil, rep).measureLag(context.Background(), rep, replay); !errors.Is(err, errReplicaDown) {
+		t.Fatalf("err = %v, want the replica's error", err)
+	}
+	if rep.lag != 3*time.Second {
+		t.Fatal("a failed check changed the measured lag")
+	}
+}
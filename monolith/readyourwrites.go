@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"social-network-common/pglsn"
+)
+
+// Read-your-writes: after a write the handler calls noteWrite, which reads
+// the master's pg_current_wal_lsn() and returns it in X-Last-Write-LSN. A
+// client that sends the header back, and any request of the same user within
+// READ_YOUR_WRITES_WINDOW (30s), only reads from a replica that has replayed
+// the WAL up to that position. If none has, slaveDB waits up to
+// READ_YOUR_WRITES_WAIT (200ms) for one to catch up and then reads from the
+// master. Requests of other users read from replicas as usual.
+const lastWriteLSNHeader = "X-Last-Write-LSN"
+
+var (
+	readYourWritesWindow = envDuration("READ_YOUR_WRITES_WINDOW", 30*time.Second)
+	readYourWritesWait   = envDuration("READ_YOUR_WRITES_WAIT", 200*time.Millisecond)
+)
+
+var recentWrites = &writePositions{users: make(map[string]writePosition)}
+
+type writePosition struct {
+	lsn pglsn.LSN
+	at  time.Time
+}
+
+// writePositions remembers the last write of each user on this instance
+type writePositions struct {
+	mu         sync.Mutex
+	users      map[string]writePosition
+	lastPurged time.Time
+}
+
+func (w *writePositions) put(userId string, l pglsn.LSN) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.lastPurged) > readYourWritesWindow {
+		for id, pos := range w.users {
+			if now.Sub(pos.at) > readYourWritesWindow {
+				delete(w.users, id)
+			}
+		}
+		w.lastPurged = now
+	}
+	if l > w.users[userId].lsn {
+		w.users[userId] = writePosition{lsn: l, at: now}
+	}
+}
+
+func (w *writePositions) get(userId string) pglsn.LSN {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pos, ok := w.users[userId]
+	if !ok {
+		return 0
+	}
+	if time.Since(pos.at) > readYourWritesWindow {
+		delete(w.users, userId)
+		return 0
+	}
+	return pos.lsn
+}
+
+type readAfterContextKey struct{}
+
+// readAfter returns the WAL position reads of the request must see, 0 if any
+func readAfter(ctx context.Context) pglsn.LSN {
+	l, _ := ctx.Value(readAfterContextKey{}).(pglsn.LSN)
+	return l
+}
+
+// requireReadAfter makes the rest of the request read at least up to l
+func requireReadAfter(c *gin.Context, l pglsn.LSN) {
+	if l > readAfter(c.Request.Context()) {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), readAfterContextKey{}, l))
+	}
+}
+
+// readAfterMaster makes the reads of ctx see everything committed on the master so far
+func readAfterMaster(ctx context.Context) (context.Context, error) {
+	var l pglsn.LSN
+	if err := masterDB.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&l); err != nil {
+		return ctx, err
+	}
+	if l <= readAfter(ctx) {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, readAfterContextKey{}, l), nil
+}
+
+// readYourWrites applies the position the client sent back in X-Last-Write-LSN;
+// authMiddleware adds the user's own last write
+func readYourWrites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v := c.GetHeader(lastWriteLSNHeader); v != "" {
+			if l, err := pglsn.Parse(v); err == nil {
+				requireReadAfter(c, l)
+			}
+		}
+		c.Next()
+	}
+}
+
+// noteWrite is called after a committed write of userId
+func noteWrite(c *gin.Context, userId string) {
+	var l pglsn.LSN
+	if err := masterDB.QueryRow(c.Request.Context(), "SELECT pg_current_wal_lsn()::text").Scan(&l); err != nil {
+		log.Printf("Failed to read the WAL position after a write: %v", err)
+		return
+	}
+	recentWrites.put(userId, l)
+	c.Header(lastWriteLSNHeader, l.String())
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Real-time feed: createPost publishes a NOTIFY on postsChannel in the same
+// transaction as the INSERT, so it is delivered only after commit. Every
+// monolith instance LISTENs on master and pushes the post to its own WebSocket
+// clients that follow the author, so author and reader may sit on different
+// instances.
+//
+// The same channel carries the feed cache changes other instances have to
+// repeat: deleted posts and feeds invalidated by a friendship change. Those are
+// sent after the commit and may be lost with the listener's connection; the
+// cached feeds then catch up after FEED_CACHE_TTL.
+//
+// Each client has a bounded send queue. A client that can't keep up gets
+// disconnected instead of slowing down delivery for everyone else; it can
+// catch up with GET /post/feed after reconnecting.
+const (
+	postsChannel = "posts_posted"
+
+	wsSendQueue    = 64
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 50 * time.Second
+)
+
+// instanceId tells this instance's notifications from the others'
+var instanceId = uuid.New().String()
+
+// Events of postNotification; a new post has none
+const (
+	postEventDeleted     = "deleted"
+	postEventInvalidated = "invalidated"
+)
+
+type postNotification struct {
+	Event        string    `json:"event,omitempty"`
+	PostID       string    `json:"post_id,omitempty"`
+	AuthorUserID string    `json:"author_user_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UserID       string    `json:"user_id,omitempty"` // whose feed is invalidated
+	Instance     string    `json:"instance"`
+}
+
+// notifyPosts sends a feed cache change to the other instances
+func notifyPosts(ctx context.Context, note postNotification) {
+	note.Instance = instanceId
+	payload, _ := json.Marshal(note)
+	if _, err := masterDB.Exec(ctx, "SELECT pg_notify($1, $2)", postsChannel, string(payload)); err != nil {
+		log.Printf("Failed to notify %s about %s: %v", postsChannel, note.Event, err)
+	}
+}
+
+type wsClient struct {
+	userId string
+	conn   *websocket.Conn
+	send   chan []byte
+	once   sync.Once
+	slow   atomic.Bool
+}
+
+// close stops the writer; the connection itself is closed by the writer goroutine
+func (cl *wsClient) close() {
+	cl.once.Do(func() { close(cl.send) })
+}
+
+type feedHub struct {
+	mu      sync.RWMutex
+	clients map[string]map[*wsClient]struct{} // userId -> connections
+}
+
+var hub = &feedHub{clients: make(map[string]map[*wsClient]struct{})}
+
+func (h *feedHub) register(cl *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[cl.userId] == nil {
+		h.clients[cl.userId] = make(map[*wsClient]struct{})
+	}
+	h.clients[cl.userId][cl] = struct{}{}
+}
+
+func (h *feedHub) unregister(cl *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if conns := h.clients[cl.userId]; conns != nil {
+		delete(conns, cl)
+		if len(conns) == 0 {
+			delete(h.clients, cl.userId)
+		}
+	}
+	cl.close()
+}
+
+func (h *feedHub) userIds() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]string, 0, len(h.clients))
+	for id := range h.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (h *feedHub) connections() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, conns := range h.clients {
+		n += len(conns)
+	}
+	return n
+}
+
+// deliver never blocks: a full queue means a slow consumer, which is dropped
+func (h *feedHub) deliver(userId string, msg []byte) {
+	h.mu.RLock()
+	var slow []*wsClient
+	for cl := range h.clients[userId] {
+		select {
+		case cl.send <- msg:
+		default:
+			slow = append(slow, cl)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, cl := range slow {
+		log.Printf("Dropping slow feed subscriber %s", cl.userId)
+		cl.slow.Store(true)
+		h.unregister(cl)
+	}
+}
+
+// listenPosts keeps a LISTEN connection to master and dispatches notifications, reconnecting on errors
+func listenPosts(ctx context.Context) {
+	for {
+		err := listenPostsOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Posts listener stopped: %v, reconnecting", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func listenPostsOnce(ctx context.Context) error {
+	// Reconnect to the new master after a failover even if the old one is still up
+	ctx, cancel := masterDB.untilChanged(ctx)
+	defer cancel()
+
+	conn, err := masterDB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// A connection that has run LISTEN must not go back to the pool
+	defer conn.Hijack().Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+postsChannel); err != nil {
+		return err
+	}
+	log.Printf("Listening for new posts on %q", postsChannel)
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var note postNotification
+		if err := json.Unmarshal([]byte(n.Payload), &note); err != nil {
+			log.Printf("Bad %s payload %q: %v", postsChannel, n.Payload, err)
+			continue
+		}
+		// The sending instance has already applied the change to its own feed cache
+		local := note.Instance == instanceId
+		entry := feedEntry{PostID: note.PostID, AuthorID: note.AuthorUserID, CreatedAt: note.CreatedAt}
+		switch note.Event {
+		case postEventDeleted:
+			if !local {
+				retractFromFeeds(entry)
+			}
+		case postEventInvalidated:
+			if !local {
+				invalidateFeed(note.UserID)
+			}
+		default:
+			if !local {
+				publishToFeeds(entry)
+			}
+			if err := pushPost(ctx, note); err != nil {
+				log.Printf("Failed to push post %s: %v", note.PostID, err)
+			}
+		}
+	}
+}
+
+// pushPost sends the post to locally connected followers of its author
+func pushPost(ctx context.Context, note postNotification) error {
+	connected := hub.userIds()
+	if len(connected) == 0 {
+		return nil
+	}
+
+	followers, err := queryStrings(ctx,
+		`SELECT user_id::text FROM friends
+		 WHERE friend_id = $1::uuid AND user_id = ANY($2::text[]::uuid[])`,
+		note.AuthorUserID, connected)
+	if err != nil {
+		return err
+	}
+	if len(followers) == 0 {
+		return nil
+	}
+
+	// Read from master: the post has just been committed and may not be on the replica yet
+	p := Post{}
+	err = masterDB.QueryRow(ctx,
+		"SELECT id::text, text, author_user_id::text, created_at FROM posts WHERE id = $1::uuid",
+		note.PostID).Scan(&p.ID, &p.Text, &p.AuthorUserID, &p.CreatedAt)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	for _, userId := range followers {
+		hub.deliver(userId, msg)
+	}
+	return nil
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true }, // auth is the bearer token, not cookies
+}
+
+// feedPosted upgrades to a WebSocket and streams new posts of the user's friends
+func feedPosted(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	cl := &wsClient{userId: c.GetString("userId"), conn: conn, send: make(chan []byte, wsSendQueue)}
+	hub.register(cl)
+	go cl.writeLoop()
+	cl.readLoop()
+}
+
+// readLoop only handles control frames; it returns when the peer goes away
+func (cl *wsClient) readLoop() {
+	defer hub.unregister(cl)
+
+	cl.conn.SetReadLimit(512)
+	cl.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	cl.conn.SetPongHandler(func(string) error {
+		return cl.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	for {
+		if _, _, err := cl.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (cl *wsClient) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer func() {
+		ticker.Stop()
+		cl.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-cl.send:
+			cl.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if !ok {
+				if cl.slow.Load() {
+					cl.conn.WriteMessage(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber too slow"))
+				}
+				return
+			}
+			if err := cl.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			cl.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := cl.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
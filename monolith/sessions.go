@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Sessions live in the sessions table on master, so every monolith instance
+// sees the same sessions and a revoke takes effect everywhere at once.
+// Token is the secret refresh token; access JWTs only carry the session ID.
+type Session struct {
+	ID        string
+	Token     string
+	UserID    string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionExpired  = errors.New("session expired")
+	errSessionRevoked  = errors.New("session revoked")
+)
+
+var sessionTTL = envDuration("SESSION_TTL", 24*time.Hour)
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s=%q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type execQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func insertSession(ctx context.Context, db execQuerier, userId string) (*Session, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{ID: uuid.New().String(), Token: token, UserID: userId}
+	err = db.QueryRow(ctx,
+		`INSERT INTO sessions (id, token, user_id, issued_at, expires_at)
+		 VALUES ($1, $2, $3::uuid, now(), now() + $4::interval)
+		 RETURNING issued_at, expires_at`,
+		s.ID, s.Token, userId, sessionTTL.String()).Scan(&s.IssuedAt, &s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func createSession(ctx context.Context, userId string) (*Session, error) {
+	return insertSession(ctx, masterDB, userId)
+}
+
+// sessionCacheTTL is how long a valid session is trusted without asking the
+// master again, so a revoke on another instance takes up to that long to reach
+// this one. Revokes made here drop the entries at once.
+var sessionCacheTTL = envDuration("SESSION_CACHE_TTL", 5*time.Second)
+
+var validSessions = &sessionCache{sessions: make(map[string]cachedSession)}
+
+type cachedSession struct {
+	session *Session
+	at      time.Time
+}
+
+// sessionCache remembers the sessions recently found valid on this instance
+type sessionCache struct {
+	mu         sync.Mutex
+	sessions   map[string]cachedSession
+	lastPurged time.Time
+}
+
+func (sc *sessionCache) put(s *Session) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(sc.lastPurged) > sessionCacheTTL {
+		for id, cached := range sc.sessions {
+			if now.Sub(cached.at) > sessionCacheTTL {
+				delete(sc.sessions, id)
+			}
+		}
+		sc.lastPurged = now
+	}
+	sc.sessions[s.ID] = cachedSession{session: s, at: now}
+}
+
+func (sc *sessionCache) get(sessionId string) *Session {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	cached, ok := sc.sessions[sessionId]
+	if !ok {
+		return nil
+	}
+	if time.Since(cached.at) > sessionCacheTTL || time.Now().After(cached.session.ExpiresAt) {
+		delete(sc.sessions, sessionId)
+		return nil
+	}
+	return cached.session
+}
+
+func (sc *sessionCache) drop(sessionId string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.sessions, sessionId)
+}
+
+func (sc *sessionCache) dropUser(userId string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for id, cached := range sc.sessions {
+		if cached.session.UserID == userId {
+			delete(sc.sessions, id)
+		}
+	}
+}
+
+// checkSession is lookupSession behind validSessions: authMiddleware runs on
+// every request and would otherwise query the master each time
+func checkSession(ctx context.Context, sessionId string) (*Session, error) {
+	if s := validSessions.get(sessionId); s != nil {
+		return s, nil
+	}
+	s, err := lookupSession(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	validSessions.put(s)
+	return s, nil
+}
+
+// lookupSession reads from master: a session issued a moment ago or revoked on
+// another instance must be seen immediately, regardless of replication lag.
+func lookupSession(ctx context.Context, sessionId string) (*Session, error) {
+	s := &Session{ID: sessionId}
+	var revokedAt *time.Time
+	err := masterDB.QueryRow(ctx,
+		"SELECT user_id::text, issued_at, expires_at, revoked_at FROM sessions WHERE id::text = $1",
+		sessionId).Scan(&s.UserID, &s.IssuedAt, &s.ExpiresAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt != nil {
+		return nil, errSessionRevoked
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, errSessionExpired
+	}
+	return s, nil
+}
+
+func revokeSession(ctx context.Context, sessionId string) error {
+	validSessions.drop(sessionId)
+	_, err := masterDB.Exec(ctx,
+		"UPDATE sessions SET revoked_at = now() WHERE id = $1::uuid AND revoked_at IS NULL",
+		sessionId)
+	return err
+}
+
+func revokeUserSessions(ctx context.Context, userId string) (int64, error) {
+	validSessions.dropUser(userId)
+	tag, err := masterDB.Exec(ctx,
+		"UPDATE sessions SET revoked_at = now() WHERE user_id = $1::uuid AND revoked_at IS NULL",
+		userId)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// refreshSession revokes the session owning the refresh token and issues a new
+// one for the same user in a single transaction, so a token can be used only once.
+func refreshSession(ctx context.Context, refreshToken string) (*Session, error) {
+	tx, err := masterDB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var oldId, userId string
+	err = tx.QueryRow(ctx,
+		`UPDATE sessions SET revoked_at = now()
+		 WHERE token = $1 AND revoked_at IS NULL AND expires_at > now()
+		 RETURNING id::text, user_id::text`,
+		refreshToken).Scan(&oldId, &userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+	validSessions.drop(oldId)
+
+	s, err := insertSession(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// purgeExpiredSessions periodically removes sessions that expired more than a day ago
+func purgeExpiredSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tag, err := masterDB.Exec(context.Background(),
+			"DELETE FROM sessions WHERE expires_at < now() - interval '1 day'")
+		if err != nil {
+			log.Printf("Failed to purge expired sessions: %v", err)
+			continue
+		}
+		if tag.RowsAffected() > 0 {
+			log.Printf("Purged %d expired sessions", tag.RowsAffected())
+		}
+	}
+}
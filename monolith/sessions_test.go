@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionCache(t *testing.T) {
+	sc := &sessionCache{sessions: make(map[string]cachedSession)}
+	alive := time.Now().Add(time.Hour)
+	sc.put(&Session{ID: "s1", UserID: "u1", ExpiresAt: alive})
+	sc.put(&Session{ID: "s2", UserID: "u1", ExpiresAt: alive})
+	sc.put(&Session{ID: "s3", UserID: "u2", ExpiresAt: alive})
+	sc.put(&Session{ID: "expired", UserID: "u2", ExpiresAt: time.Now().Add(-time.Second)})
+
+	if sc.get("s1") == nil || sc.get("s3") == nil {
+		t.Fatal("a cached session is not found")
+	}
+	if sc.get("expired") != nil {
+		t.Fatal("an expired session is returned")
+	}
+
+	sc.drop("s3")
+	if sc.get("s3") != nil {
+		t.Fatal("a dropped session is returned")
+	}
+	sc.dropUser("u1")
+	if sc.get("s1") != nil || sc.get("s2") != nil {
+		t.Fatal("a session of a user logged out everywhere is returned")
+	}
+
+	sc.put(&Session{ID: "s4", UserID: "u3", ExpiresAt: alive})
+	sc.sessions["s4"] = cachedSession{session: sc.sessions["s4"].session, at: time.Now().Add(-sessionCacheTTL - time.Second)}
+	if sc.get("s4") != nil {
+		t.Fatal("a session is trusted past SESSION_CACHE_TTL")
+	}
+}
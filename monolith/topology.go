@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"social-network-common/env"
+)
+
+// With DB_NODES=name=url,name=url (every node of the cluster) the monolith
+// follows failovers itself instead of relying on target_session_attrs: every
+// TOPOLOGY_INTERVAL (2s) each node is asked pg_is_in_recovery(). The node that
+// is not in recovery is the master and masterDB points to it; the nodes in
+// recovery are the read replicas. When a replica gets promoted both move over
+// on the next check. If several nodes claim to be the master (an old master
+// came back without being rewound) the one that accepts writes wins over a
+// fenced one (default_transaction_read_only, see pgctl fence), then the one on
+// the highest timeline; among equals the current master is kept. A node that
+// does not answer is left out until it does. GET /admin/topology shows the
+// current view to callers with X-Admin-Token: ADMIN_TOKEN and is off without
+// ADMIN_TOKEN. Without DB_NODES the monolith uses MASTER_DB_URL and
+// READ_REPLICAS as they are.
+const (
+	roleMaster  = "master"
+	roleReplica = "replica"
+	roleDown    = "down"
+)
+
+var clusterTopology *topology
+
+// masterPool is the master connection pool that can be re-pointed at runtime
+type masterPool struct {
+	pool    atomic.Pointer[pgxpool.Pool]
+	mu      sync.Mutex
+	changed chan struct{} // closed when the pool is re-pointed
+}
+
+func newMasterPool(pool *pgxpool.Pool) *masterPool {
+	m := &masterPool{changed: make(chan struct{})}
+	m.pool.Store(pool)
+	return m
+}
+
+func (m *masterPool) set(pool *pgxpool.Pool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pool.Swap(pool) != pool {
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+}
+
+// untilChanged returns a context canceled when the master is re-pointed, for
+// long-lived connections such as the posts listener
+func (m *masterPool) untilChanged(ctx context.Context) (context.Context, context.CancelFunc) {
+	m.mu.Lock()
+	changed := m.changed
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (m *masterPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return m.pool.Load().Exec(ctx, sql, args...)
+}
+
+func (m *masterPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return m.pool.Load().Query(ctx, sql, args...)
+}
+
+func (m *masterPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return m.pool.Load().QueryRow(ctx, sql, args...)
+}
+
+func (m *masterPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	return m.pool.Load().Begin(ctx)
+}
+
+func (m *masterPool) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return m.pool.Load().SendBatch(ctx, b)
+}
+
+func (m *masterPool) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	return m.pool.Load().Acquire(ctx)
+}
+
+func (m *masterPool) Close() {
+	m.pool.Load().Close()
+}
+
+type dbNode struct {
+	// the node's pool, used as a read replica while the node is in recovery
+	*replica
+
+	// guarded by topology.mu
+	role      string
+	readOnly  bool   // default_transaction_read_only is on
+	timeline  uint32 // 0 if unknown
+	checkedAt time.Time
+}
+
+type topology struct {
+	mu        sync.RWMutex
+	nodes     []*dbNode // sorted by name
+	master    *dbNode
+	changedAt time.Time
+}
+
+// connectTopology opens a pool per node of DB_NODES and finds the master,
+// setting masterDB and slaveDB
+func connectTopology(ctx context.Context, list string) (*topology, error) {
+	urls, err := env.ParseList(list)
+	if err != nil {
+		return nil, fmt.Errorf("DB_NODES: %w", err)
+	}
+	t := &topology{}
+	for name, url := range urls {
+		rep, err := newReplica(ctx, name, url)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.nodes = append(t.nodes, &dbNode{replica: rep, role: roleDown})
+	}
+	sort.Slice(t.nodes, func(i, j int) bool { return t.nodes[i].name < t.nodes[j].name })
+
+	slaveDB = newReadRouter(nil)
+	t.refresh(ctx)
+	if t.master == nil {
+		t.Close()
+		return nil, errNoMaster
+	}
+	return t, nil
+}
+
+var errNoMaster = errors.New("no node of DB_NODES is out of recovery")
+
+func (t *topology) Close() {
+	for _, node := range t.nodes {
+		node.pool.Close()
+	}
+}
+
+// watch re-checks the topology until ctx is done
+func (t *topology) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.refresh(ctx)
+	}
+}
+
+// nodeCheck is the result of checking one node
+type nodeCheck struct {
+	role     string
+	readOnly bool
+	timeline uint32
+	err      error
+}
+
+func checkNode(ctx context.Context, node *dbNode) nodeCheck {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	var inRecovery bool
+	var check nodeCheck
+	check.err = node.db.QueryRow(ctx,
+		"SELECT pg_is_in_recovery(), current_setting('default_transaction_read_only')::bool").
+		Scan(&inRecovery, &check.readOnly)
+	switch {
+	case check.err != nil:
+		check.role = roleDown
+		return check
+	case inRecovery:
+		check.role = roleReplica
+		return check
+	}
+	check.role = roleMaster
+	// pg_control_checkpoint() may not be granted to the application role; the
+	// timeline only breaks ties, so it is left unknown then
+	var timeline int64
+	if err := node.db.QueryRow(ctx, "SELECT timeline_id FROM pg_control_checkpoint()").Scan(&timeline); err == nil {
+		check.timeline = uint32(timeline)
+	}
+	return check
+}
+
+// betterMaster reports whether a should be the master rather than b
+func betterMaster(a, b *dbNode) bool {
+	if a.readOnly != b.readOnly {
+		return !a.readOnly
+	}
+	return a.timeline > b.timeline
+}
+
+func (t *topology) refresh(ctx context.Context) {
+	checks := make([]nodeCheck, len(t.nodes))
+	var wg sync.WaitGroup
+	for i, node := range t.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checks[i] = checkNode(ctx, node)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var masters []*dbNode
+	var replicas []*replica
+	now := time.Now()
+	for i, node := range t.nodes {
+		check := checks[i]
+		switch {
+		case node.role != check.role && check.err != nil:
+			log.Printf("Database node %s: %s -> %s: %v", node.name, node.role, check.role, check.err)
+		case node.role != check.role:
+			log.Printf("Database node %s: %s -> %s", node.name, node.role, check.role)
+		}
+		node.role, node.readOnly, node.timeline, node.checkedAt = check.role, check.readOnly, check.timeline, now
+		switch check.role {
+		case roleMaster:
+			masters = append(masters, node)
+		case roleReplica:
+			replicas = append(replicas, node.replica)
+		}
+	}
+
+	// masters are sorted by name, so among equal candidates the first name wins
+	var best *dbNode
+	for _, node := range masters {
+		if best == nil || betterMaster(node, best) {
+			best = node
+		}
+	}
+
+	master := t.master
+	switch {
+	case best == nil:
+		if master != nil {
+			log.Printf("No database node is out of recovery, keeping %s as the master", master.name)
+		}
+	case master != nil && master.role == roleMaster && !betterMaster(best, master):
+		if len(masters) > 1 {
+			log.Printf("Several database nodes are out of recovery (%s), keeping %s as the master", nodeNames(masters), master.name)
+		}
+	default:
+		if len(masters) > 1 {
+			log.Printf("Several database nodes are out of recovery (%s), using %s as the master", nodeNames(masters), best.name)
+		}
+		master = best
+	}
+
+	if master != t.master {
+		if t.master == nil {
+			log.Printf("Database master is %s", master.name)
+			masterDB = newMasterPool(master.pool)
+		} else {
+			log.Printf("Database master moved from %s to %s", t.master.name, master.name)
+			masterDB.set(master.pool)
+		}
+		t.master, t.changedAt = master, now
+	}
+	slaveDB.setReplicas(replicas)
+}
+
+func nodeNames(nodes []*dbNode) string {
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// nodeStatus leaves out connection errors, which carry host names and
+// database details; they are logged when a node goes down
+type nodeStatus struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	ReadOnly  bool      `json:"read_only,omitempty"`
+	Timeline  uint32    `json:"timeline,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type topologyStatus struct {
+	Master    string       `json:"master"`
+	ChangedAt time.Time    `json:"changed_at"`
+	Nodes     []nodeStatus `json:"nodes"`
+}
+
+func (t *topology) status() topologyStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := topologyStatus{ChangedAt: t.changedAt, Nodes: make([]nodeStatus, 0, len(t.nodes))}
+	if t.master != nil {
+		result.Master = t.master.name
+	}
+	for _, node := range t.nodes {
+		result.Nodes = append(result.Nodes, nodeStatus{
+			Name:      node.name,
+			Role:      node.role,
+			ReadOnly:  node.readOnly,
+			Timeline:  node.timeline,
+			CheckedAt: node.checkedAt,
+		})
+	}
+	return result
+}
+
+const adminTokenHeader = "X-Admin-Token"
+
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// adminAuth lets through requests carrying ADMIN_TOKEN in X-Admin-Token; the
+// admin API is off when ADMIN_TOKEN is not set
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Admin API is disabled, ADMIN_TOKEN is not set"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(adminTokenHeader)), []byte(adminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func getTopology(c *gin.Context) {
+	if clusterTopology == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Topology is not watched, DB_NODES is not set"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"topology":      clusterTopology.status(),
+		"read_replicas": slaveDB.status(),
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBetterMaster(t *testing.T) {
+	node := func(readOnly bool, timeline uint32) *dbNode {
+		return &dbNode{readOnly: readOnly, timeline: timeline}
+	}
+	for _, tc := range []struct {
+		name string
+		a, b *dbNode
+		want bool
+	}{
+		{"writable over fenced", node(false, 1), node(true, 1), true},
+		{"fenced under writable", node(true, 1), node(false, 1), false},
+		{"writable over fenced on a later timeline", node(false, 1), node(true, 5), true},
+		{"later timeline", node(false, 3), node(false, 2), true},
+		{"earlier timeline", node(false, 2), node(false, 3), false},
+		{"known timeline over unknown", node(false, 1), node(false, 0), true},
+		{"tie", node(false, 2), node(false, 2), false},
+		{"fenced tie", node(true, 2), node(true, 2), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := betterMaster(tc.a, tc.b); got != tc.want {
+				t.Fatalf("betterMaster = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// fakeNode is what checkNode sees of a node
+type fakeNode struct {
+	down       bool
+	inRecovery bool
+	readOnly   bool
+	timeline   int64
+}
+
+func TestTopologyRefresh(t *testing.T) {
+	oldMaster, oldSlave := masterDB, slaveDB
+	t.Cleanup(func() { masterDB, slaveDB = oldMaster, oldSlave })
+	masterDB, slaveDB = nil, newReadRouter(nil)
+
+	states := map[string]*fakeNode{}
+	topo := &topology{}
+	for _, name := range []string{"a", "b", "c"} {
+		state := &fakeNode{}
+		states[name] = state
+		db := &fakeReplicaDB{answer: func(sql string) ([]any, error) {
+			switch {
+			case state.down:
+				return nil, errReplicaDown
+			case strings.Contains(sql, "pg_is_in_recovery"):
+				return []any{state.inRecovery, state.readOnly}, nil
+			default:
+				return []any{state.timeline}, nil
+			}
+		}}
+		topo.nodes = append(topo.nodes, &dbNode{replica: fakeReplica(name, db), role: roleDown})
+	}
+
+	master := func(timeline int64) fakeNode { return fakeNode{timeline: timeline} }
+	fenced := func(timeline int64) fakeNode { return fakeNode{readOnly: true, timeline: timeline} }
+	standby := fakeNode{inRecovery: true}
+	down := fakeNode{down: true}
+
+	// the steps run in order on the same topology
+	for _, step := range []struct {
+		name         string
+		a, b, c      fakeNode
+		wantMaster   string
+		wantReplicas []string
+	}{
+		{"start", master(1), standby, standby, "a", []string{"b", "c"}},
+		{"replica down", master(1), standby, down, "a", []string{"b"}},
+		{"failover", down, master(2), standby, "b", []string{"c"}},
+		{"old master back unfenced", master(1), master(2), standby, "b", []string{"c"}},
+		{"old master rewound", standby, master(2), standby, "b", []string{"a", "c"}},
+		{"no master", standby, down, standby, "b", []string{"a", "c"}},
+		{"highest timeline, first name on a tie", master(3), master(2), master(3), "a", nil},
+		{"fenced master loses", fenced(3), standby, master(3), "c", []string{"b"}},
+		{"fenced node on a later timeline loses", fenced(4), standby, master(3), "c", []string{"b"}},
+		{"current master kept on a tie", master(3), standby, master(3), "c", []string{"b"}},
+		{"only a fenced node out of recovery", fenced(4), standby, standby, "a", []string{"b", "c"}},
+	} {
+		*states["a"], *states["b"], *states["c"] = step.a, step.b, step.c
+		topo.refresh(context.Background())
+
+		if topo.master == nil || topo.master.name != step.wantMaster {
+			t.Fatalf("%s: master %v, want %s", step.name, topo.master, step.wantMaster)
+		}
+		var replicas []string
+		for _, rep := range slaveDB.all() {
+			replicas = append(replicas, rep.name)
+		}
+		if !reflect.DeepEqual(replicas, step.wantReplicas) {
+			t.Fatalf("%s: replicas %v, want %v", step.name, replicas, step.wantReplicas)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 #!/bin/bash
 set -euo pipefail
 
+# Только первичное клонирование пустого PGDATA (pg_basebackup идет по протоколу
+# репликации, не через SQL). Переключение реплик на другой primary, промоут и
+# синхронная репликация - cmd/pgctl.
 PGDATA="${PGDATA:-/var/lib/postgresql/data}"
 ROLE="${PGAPPNAME:-slave1}"
-MASTER="postgres-master"
-PORT="5432"
-USER="user"
-PASS="password"
+MASTER="${PRIMARY_HOST:-postgres-master}"
+PORT="${PRIMARY_PORT:-5432}"
+USER="${REPLICATION_USER:-user}"
+PASS="${REPLICATION_PASSWORD:-password}"
 
 echo "[replica] waiting for master ${MASTER}:${PORT} ..."
 until pg_isready -h "$MASTER" -p "$PORT" -q; do sleep 1; done